@@ -0,0 +1,108 @@
+package aoisim
+
+import (
+	"math"
+	"math/rand"
+
+	"game-toolkit/aoi"
+)
+
+// Mover 移动模式，决定每个Entity的出生位置和每一帧的移动，同一个Mover只用于一次模拟
+type Mover interface {
+	// Spawn 第i个Entity的出生位置
+	Spawn(rnd *rand.Rand, i int) aoi.Position
+	// Next 第i个Entity从pos出发，下一帧移动到的位置
+	Next(rnd *rand.Rand, i int, pos aoi.Position) aoi.Position
+}
+
+// RandomWalk 在[0, Width] * [0, Height]的地图上随机游走，野外地图
+type RandomWalk struct {
+	Width  float32
+	Height float32
+	Step   float32 // 每帧在X、Y方向上各自最多移动的距离
+}
+
+func (w RandomWalk) Spawn(rnd *rand.Rand, i int) aoi.Position {
+	return aoi.Position{X: rnd.Float32() * w.Width, Y: rnd.Float32() * w.Height}
+}
+
+func (w RandomWalk) Next(rnd *rand.Rand, i int, pos aoi.Position) aoi.Position {
+	pos.X = clamp(pos.X+randomStep(rnd, w.Step), 0, w.Width)
+	pos.Y = clamp(pos.Y+randomStep(rnd, w.Step), 0, w.Height)
+	return pos
+}
+
+// Cluster 挤在几个中心附近随机游走，走出Radius之后往中心走，主城、副本门口
+type Cluster struct {
+	Centers []aoi.Position
+	Radius  float32
+	Step    float32
+}
+
+func (c Cluster) Spawn(rnd *rand.Rand, i int) aoi.Position {
+	center := c.Centers[i%len(c.Centers)]
+	return aoi.Position{X: center.X + randomStep(rnd, c.Radius), Y: center.Y + randomStep(rnd, c.Radius)}
+}
+
+func (c Cluster) Next(rnd *rand.Rand, i int, pos aoi.Position) aoi.Position {
+	center := c.Centers[i%len(c.Centers)]
+	if dx, dy := pos.X-center.X, pos.Y-center.Y; dx*dx+dy*dy > c.Radius*c.Radius {
+		return towards(pos, center, c.Step)
+	}
+	pos.X += randomStep(rnd, c.Step)
+	pos.Y += randomStep(rnd, c.Step)
+	return pos
+}
+
+// Patrol 沿着固定的路径来回巡逻，第i个Entity走第i%len(Paths)条路径，从路径上不同的点出发
+type Patrol struct {
+	Paths [][]aoi.Position // 每条路径至少两个点，走到终点后回到起点
+	Speed float32          // 每帧移动的距离
+
+	targets map[int]int // 每个Entity下一个要去的点
+}
+
+func (p *Patrol) Spawn(rnd *rand.Rand, i int) aoi.Position {
+	if p.targets == nil {
+		p.targets = make(map[int]int)
+	}
+	path := p.Paths[i%len(p.Paths)]
+	start := rnd.Intn(len(path))
+	p.targets[i] = (start + 1) % len(path)
+	return path[start]
+}
+
+func (p *Patrol) Next(rnd *rand.Rand, i int, pos aoi.Position) aoi.Position {
+	path := p.Paths[i%len(p.Paths)]
+	target := path[p.targets[i]]
+	next := towards(pos, target, p.Speed)
+	if next == target {
+		p.targets[i] = (p.targets[i] + 1) % len(path)
+	}
+	return next
+}
+
+func randomStep(rnd *rand.Rand, step float32) float32 {
+	return (rnd.Float32()*2 - 1) * step
+}
+
+func clamp(v, min, max float32) float32 {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+// 从pos朝target移动step的距离，不会越过target
+func towards(pos, target aoi.Position, step float32) aoi.Position {
+	dx, dy := float64(target.X-pos.X), float64(target.Y-pos.Y)
+	d := math.Sqrt(dx*dx + dy*dy)
+	if d <= float64(step) {
+		return target
+	}
+	ratio := float64(step) / d
+	return aoi.Position{X: pos.X + float32(dx*ratio), Y: pos.Y + float32(dy*ratio), Z: pos.Z}
+}
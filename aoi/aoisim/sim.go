@@ -0,0 +1,120 @@
+package aoisim
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"time"
+
+	"game-toolkit/aoi"
+)
+
+/*
+	[思路]
+	不同地图适合的AOI实现不一样: 野外地广人稀，主城人挤人，副本里怪物沿固定路线巡逻。
+	模拟器按Mover生成N个Entity，每一帧让一部分Entity移动，统计每帧的事件数、每次Move的耗时和场景占用的内存，
+	同样的Config和Seed对任意aoi.Scene实现产生完全相同的移动序列，结果可以直接横向比较
+	耗时是单个goroutine里Move调用的墙钟时间，不是CPU时间，包含同步投递事件的开销，Listener只计数，不做其他工作；
+	机器上有其他负载时墙钟时间会偏大，横向比较时需要在同样的环境下运行
+*/
+
+type Config struct {
+	Entities  int     // Entity数量
+	Ticks     int     // 模拟的帧数
+	MoveRatio float64 // 每帧移动的Entity比例，<=0或者>1时每帧全部移动
+	Mover     Mover   // 移动模式
+	Seed      int64   // 随机种子，相同的种子产生相同的移动序列
+}
+
+type Report struct {
+	Entities     int
+	Ticks        int
+	Moves        int                   // Move调用次数
+	Events       int                   // 移动阶段收到的事件总数，不包括进场
+	EventsByType map[aoi.EventType]int // 按类型统计的移动阶段事件数
+	MoveWallTime time.Duration         // 所有Move调用和每帧Flush的墙钟时间之和
+	HeapBytes    uint64                // 创建场景并全部进场之后增加的堆内存
+}
+
+func (r Report) EventsPerTick() float64 {
+	if r.Ticks == 0 {
+		return 0
+	}
+	return float64(r.Events) / float64(r.Ticks)
+}
+
+// WallTimePerMove 平均每次Move(含分摊的Flush)的墙钟时间
+func (r Report) WallTimePerMove() time.Duration {
+	if r.Moves == 0 {
+		return 0
+	}
+	return r.MoveWallTime / time.Duration(r.Moves)
+}
+
+func (r Report) String() string {
+	return fmt.Sprintf("entities %d, ticks %d, events/tick %.1f (enter %d, leave %d, move %d), %v wall/move, heap %.1fKB",
+		r.Entities, r.Ticks, r.EventsPerTick(),
+		r.EventsByType[aoi.EventEnter]+r.EventsByType[aoi.EventSync], r.EventsByType[aoi.EventLeave], r.EventsByType[aoi.EventMove],
+		r.WallTimePerMove(), float64(r.HeapBytes)/1024)
+}
+
+// Run 用newScene创建场景，按config模拟之后返回统计结果，场景实现了aoi.Flusher时每帧末尾调用Flush
+func Run(newScene func() aoi.Scene, config Config) (report Report, err error) {
+	rnd := rand.New(rand.NewSource(config.Seed))
+	report = Report{Entities: config.Entities, Ticks: config.Ticks, EventsByType: make(map[aoi.EventType]int)}
+	counting := false
+	listener := aoi.ListenerFunc(func(ev aoi.Event) {
+		if counting {
+			report.Events++
+			report.EventsByType[ev.Type]++
+		}
+	})
+
+	before := heapAlloc()
+	scene := newScene()
+	positions := make([]aoi.Position, config.Entities)
+	for i := range positions {
+		positions[i] = config.Mover.Spawn(rnd, i)
+		if err = scene.Enter(int64(i+1), positions[i], listener); err != nil {
+			return
+		}
+	}
+	flusher, _ := scene.(aoi.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	if after := heapAlloc(); after > before {
+		report.HeapBytes = after - before
+	}
+
+	counting = true
+	for tick := 0; tick < config.Ticks; tick++ {
+		for i := range positions {
+			if config.MoveRatio > 0 && config.MoveRatio < 1 && rnd.Float64() >= config.MoveRatio {
+				continue
+			}
+			positions[i] = config.Mover.Next(rnd, i, positions[i])
+			start := time.Now()
+			err = scene.Move(int64(i+1), positions[i])
+			report.MoveWallTime += time.Since(start)
+			report.Moves++
+			if err != nil {
+				return
+			}
+		}
+		if flusher != nil {
+			start := time.Now()
+			flusher.Flush()
+			report.MoveWallTime += time.Since(start)
+		}
+	}
+	runtime.KeepAlive(scene)
+	return
+}
+
+func heapAlloc() uint64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
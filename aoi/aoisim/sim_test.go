@@ -0,0 +1,142 @@
+package aoisim
+
+import (
+	"math/rand"
+	"testing"
+
+	"game-toolkit/aoi"
+	"game-toolkit/aoi/infinitySight"
+	"game-toolkit/aoi/limitSight/crosschain"
+	"game-toolkit/aoi/limitSight/grid"
+	"game-toolkit/aoi/limitSight/quadtree"
+)
+
+// 视野都在20左右，方便横向比较
+var backends = []struct {
+	name     string
+	newScene func() aoi.Scene
+}{
+	{"grid", func() aoi.Scene { return grid.NewScene(grid.Config{GridSize: 20}) }},
+	{"grid-batch", func() aoi.Scene { return grid.NewScene(grid.Config{GridSize: 20, Batch: true}) }},
+	{"crosschain", func() aoi.Scene { return crosschain.NewScene(crosschain.Config{Sight: 20}) }},
+	{"quadtree", func() aoi.Scene { return quadtree.NewScene(quadtree.Config{ViewDistance: 20}) }},
+}
+
+var scenarios = []struct {
+	name   string
+	config func() Config
+}{
+	{"field", func() Config {
+		return Config{Entities: 1000, Ticks: 10, Mover: RandomWalk{Width: 2000, Height: 2000, Step: 3}}
+	}},
+	{"city", func() Config {
+		return Config{Entities: 1000, Ticks: 10, Mover: Cluster{Centers: []aoi.Position{{X: 100, Y: 100}, {X: 400, Y: 100}}, Radius: 30, Step: 2}}
+	}},
+	{"patrol", func() Config {
+		paths := [][]aoi.Position{
+			{{X: 0, Y: 0}, {X: 300, Y: 0}, {X: 300, Y: 300}},
+			{{X: 150, Y: -50}, {X: 150, Y: 350}},
+		}
+		return Config{Entities: 500, Ticks: 10, MoveRatio: 0.5, Mover: &Patrol{Paths: paths, Speed: 4}}
+	}},
+}
+
+func TestRun(t *testing.T) {
+	for _, backend := range backends {
+		for _, scenario := range scenarios {
+			// 测试里缩小规模，完整的规模见BenchmarkScenes
+			// 一个Mover只能用于一次模拟，第二次重新生成Config
+			config := func() Config {
+				config := scenario.config()
+				config.Entities /= 5
+				return config
+			}
+			first, err := Run(backend.newScene, config())
+			if err != nil {
+				t.Fatal(err)
+			}
+			second, err := Run(backend.newScene, config())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if first.Moves == 0 || first.Events == 0 {
+				t.Fatalf("%s/%s: nothing happened: %v", backend.name, scenario.name, first)
+			}
+			// 相同的种子产生相同的移动序列和事件
+			if first.Moves != second.Moves || first.Events != second.Events {
+				t.Fatalf("%s/%s: not deterministic: %v, %v", backend.name, scenario.name, first, second)
+			}
+			t.Logf("%s/%s: %v", backend.name, scenario.name, first)
+		}
+	}
+}
+
+func TestEventsPerTick(t *testing.T) {
+	// 广播场景里每次移动都会通知其他所有Entity
+	report, err := Run(func() aoi.Scene { return infinitySight.NewScene() }, Config{Entities: 20, Ticks: 5, Mover: RandomWalk{Width: 100, Height: 100, Step: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Moves != 100 || report.Events != 100*19 || report.EventsByType[aoi.EventMove] != report.Events {
+		t.Fatalf("unexpected report %v", report)
+	}
+	if report.EventsPerTick() != 20*19 {
+		t.Fatalf("events per tick %v", report.EventsPerTick())
+	}
+}
+
+func TestMover(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	walk := RandomWalk{Width: 10, Height: 10, Step: 4}
+	for i := 0; i < 100; i++ {
+		pos := walk.Spawn(rnd, i)
+		for j := 0; j < 10; j++ {
+			pos = walk.Next(rnd, i, pos)
+			if pos.X < 0 || pos.X > 10 || pos.Y < 0 || pos.Y > 10 {
+				t.Fatalf("random walk out of map: %+v", pos)
+			}
+		}
+	}
+
+	patrol := &Patrol{Paths: [][]aoi.Position{{{X: 0}, {X: 10}}}, Speed: 3}
+	pos := patrol.Spawn(rnd, 0)
+	visited := make(map[aoi.Position]bool)
+	for j := 0; j < 20; j++ {
+		pos = patrol.Next(rnd, 0, pos)
+		visited[pos] = true
+	}
+	if !visited[aoi.Position{X: 0}] || !visited[aoi.Position{X: 10}] {
+		t.Fatalf("patrol should reach both ends: %v", visited)
+	}
+
+	cluster := Cluster{Centers: []aoi.Position{{X: 100}}, Radius: 5, Step: 1}
+	pos = cluster.Spawn(rnd, 0)
+	for j := 0; j < 1000; j++ {
+		pos = cluster.Next(rnd, 0, pos)
+		if dx, dy := pos.X-100, pos.Y; dx*dx+dy*dy > 7*7 {
+			t.Fatalf("cluster wanders too far: %+v", pos)
+		}
+	}
+}
+
+// go test -bench . -run ^$ ./aoi/aoisim 对比各个实现在不同地图上的表现
+func BenchmarkScenes(b *testing.B) {
+	for _, scenario := range scenarios {
+		for _, backend := range backends {
+			b.Run(scenario.name+"/"+backend.name, func(b *testing.B) {
+				var report Report
+				for i := 0; i < b.N; i++ {
+					config := scenario.config()
+					config.Seed = int64(i)
+					var err error
+					if report, err = Run(backend.newScene, config); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(report.EventsPerTick(), "events/tick")
+				b.ReportMetric(float64(report.WallTimePerMove().Nanoseconds()), "wall-ns/move")
+				b.ReportMetric(float64(report.HeapBytes)/1024, "heapKB")
+			})
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package aoitest
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"game-toolkit/aoi"
+)
+
+const cappedLimit = 3
+
+// RunCapped 用aoi.CappedScene包装newScene返回的场景，所有Entity都在同一个簇内，内部场景里互相可见
+// 随机移动之后检查每个Watcher保留的正好是优先级最高的cappedLimit个，并且由事件推导出的可见集合和Visible一致
+func RunCapped(t *testing.T, newScene func() aoi.Scene) {
+	t.Helper()
+	t.Run("distance", func(t *testing.T) {
+		runCapped(t, newScene(), nil, nil)
+	})
+	t.Run("party", func(t *testing.T) {
+		// 队友的优先级总是高于陌生人，队伍变化后通过Refresh生效
+		party := make(map[int64]int)
+		priority := func(watcher, target int64, watcherPos, targetPos aoi.Position) float64 {
+			p := aoi.DistancePriority(watcher, target, watcherPos, targetPos)
+			if party[watcher] != 0 && party[watcher] == party[target] {
+				p += 1000
+			}
+			return p
+		}
+		runCapped(t, newScene(), priority, party)
+	})
+	t.Run("leave", func(t *testing.T) {
+		runCappedLeave(t, newScene())
+	})
+}
+
+// 离开的Entity不能再收到enter: 有的内部场景离开时会给自己发leave，不能因此从候选里补上新的
+func runCappedLeave(t *testing.T, inner aoi.Scene) {
+	scene := aoi.NewCappedScene(inner, cappedLimit, nil)
+	var events []aoi.Event
+	listener := aoi.ListenerFunc(func(ev aoi.Event) {
+		events = append(events, ev)
+	})
+	for id := int64(1); id <= 2*cappedLimit; id++ {
+		if err := scene.Enter(id, aoi.Position{X: float32(id)}, listener); err != nil {
+			t.Fatal(err)
+		}
+	}
+	scene.Flush()
+
+	events = nil
+	if err := scene.Leave(1); err != nil {
+		t.Fatal(err)
+	}
+	scene.Flush()
+	for _, ev := range events {
+		if ev.WatcherId == 1 && ev.Type != aoi.EventLeave {
+			t.Fatalf("leaving entity received %v", ev)
+		}
+	}
+	// 其他人的保留集合里去掉1之后按优先级补上
+	if got := scene.Visible(2); len(got) != cappedLimit {
+		t.Fatalf("visible of 2 is %v, expect %d entities", got, cappedLimit)
+	}
+	for _, id := range scene.Visible(2) {
+		if id == 1 {
+			t.Fatalf("2 still sees the leaving entity")
+		}
+	}
+	if err := scene.Leave(1); !errors.Is(err, aoi.ErrEntityNotFound) {
+		t.Fatalf("leave twice: %v", err)
+	}
+}
+
+func runCapped(t *testing.T, inner aoi.Scene, priority aoi.Priority, party map[int64]int) {
+	scene := aoi.NewCappedScene(inner, cappedLimit, priority)
+	if priority == nil {
+		priority = aoi.DistancePriority
+	}
+	visible := make(map[int64]map[int64]struct{}) // 由事件推导出的可见集合
+	var failed string
+	listener := aoi.ListenerFunc(func(ev aoi.Event) {
+		set := visible[ev.WatcherId]
+		_, ok := set[ev.TargetId]
+		switch ev.Type {
+		case aoi.EventEnter, aoi.EventSync:
+			if ok {
+				failed = "duplicate enter"
+			}
+			set[ev.TargetId] = struct{}{}
+		case aoi.EventLeave:
+			if !ok {
+				failed = "leave of invisible target"
+			}
+			delete(set, ev.TargetId)
+		case aoi.EventMove:
+			if !ok {
+				failed = "move of invisible target"
+			}
+		}
+	})
+	positions := make(map[int64]aoi.Position)
+	rnd := rand.New(rand.NewSource(1))
+	randomPos := func() aoi.Position {
+		return aoi.Position{X: float32(rnd.Intn(4*clusterSpan)) / 4, Y: float32(rnd.Intn(4*clusterSpan)) / 4}
+	}
+
+	for i := 0; i < 300; i++ {
+		id := int64(rnd.Intn(8) + 1)
+		_, in := positions[id]
+		var err error
+		switch op := rnd.Intn(10); {
+		case !in:
+			visible[id] = make(map[int64]struct{})
+			positions[id] = randomPos()
+			err = scene.Enter(id, positions[id], listener)
+		case op == 0:
+			// 有的实现离开时会给自己发leave，离开之后再清理
+			err = scene.Leave(id)
+			delete(positions, id)
+			delete(visible, id)
+		case op == 1 && party != nil:
+			party[id] = rnd.Intn(3)
+			err = scene.Refresh(id)
+		default:
+			positions[id] = randomPos()
+			err = scene.Move(id, positions[id])
+		}
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		// 批量模式的内部场景每一步都当做一帧
+		scene.Flush()
+		if failed != "" {
+			t.Fatalf("step %d: %s", i, failed)
+		}
+
+		for watcher, wp := range positions {
+			var others []int64
+			for target := range positions {
+				if target != watcher {
+					others = append(others, target)
+				}
+			}
+			sort.Slice(others, func(i, j int) bool {
+				pi := priority(watcher, others[i], wp, positions[others[i]])
+				pj := priority(watcher, others[j], wp, positions[others[j]])
+				if pi != pj {
+					return pi > pj
+				}
+				return others[i] < others[j]
+			})
+			if len(others) > cappedLimit {
+				others = others[:cappedLimit]
+			}
+			sort.Slice(others, func(i, j int) bool { return others[i] < others[j] })
+
+			got := scene.Visible(watcher)
+			sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+			if !sameIds(got, others) {
+				t.Fatalf("step %d: visible of %d is %v, expect %v", i, watcher, got, others)
+			}
+			var tracked []int64
+			for target := range visible[watcher] {
+				tracked = append(tracked, target)
+			}
+			sort.Slice(tracked, func(i, j int) bool { return tracked[i] < tracked[j] })
+			if !sameIds(tracked, others) {
+				t.Fatalf("step %d: events of %d lead to %v, expect %v", i, watcher, tracked, others)
+			}
+		}
+	}
+}
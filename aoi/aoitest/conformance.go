@@ -0,0 +1,257 @@
+package aoitest
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"testing"
+
+	"game-toolkit/aoi"
+)
+
+/*
+	[思路]
+	所有aoi.Scene实现共用的一致性测试。Entity被摆放在相距很远的几个簇里，
+	同一簇内的Entity坐标差都小于clusterSpan，不同簇之间至少相距clusterGap。
+	只要实现满足"同簇可见、异簇不可见"，那么对于同一份移动脚本，
+	各个实现产生的enter/leave事件集合都应当一致
+*/
+
+const (
+	clusterSpan = 8   // 簇内坐标差的上限
+	clusterGap  = 200 // 簇之间的间隔
+)
+
+type Options struct {
+	Unbounded bool // 广播类的实现，场景内所有Entity互相可见
+}
+
+type stepKind int
+
+const (
+	stepEnter stepKind = iota
+	stepLeave
+	stepMove
+)
+
+type step struct {
+	kind stepKind
+	id   int64
+	pos  aoi.Position
+}
+
+// 簇A在(0,0)附近，簇B在(200,200)附近，簇C在(400,0)附近
+var script = []step{
+	{stepEnter, 1, aoi.Position{X: 1, Y: 1}},
+	{stepEnter, 2, aoi.Position{X: 3, Y: 4}},
+	{stepEnter, 3, aoi.Position{X: 201, Y: 202}},
+	{stepEnter, 4, aoi.Position{X: 402, Y: 3}},
+	{stepMove, 1, aoi.Position{X: 205, Y: 205}},
+	{stepMove, 2, aoi.Position{X: 6, Y: 6}},
+	{stepEnter, 5, aoi.Position{X: 2, Y: 2}},
+	{stepMove, 3, aoi.Position{X: 404, Y: 6}},
+	{stepLeave, 1, aoi.Position{}},
+	{stepMove, 4, aoi.Position{X: 7, Y: 2}},
+	{stepEnter, 6, aoi.Position{X: 206, Y: 203}},
+	{stepMove, 6, aoi.Position{X: 1, Y: 7}},
+	{stepMove, 5, aoi.Position{X: 3, Y: 3}},
+	{stepLeave, 2, aoi.Position{}},
+	{stepMove, 4, aoi.Position{X: 403, Y: 1}},
+	{stepEnter, 1, aoi.Position{X: 405, Y: 5}},
+	{stepLeave, 3, aoi.Position{}},
+	{stepLeave, 4, aoi.Position{}},
+	{stepLeave, 5, aoi.Position{}},
+	{stepLeave, 6, aoi.Position{}},
+	{stepLeave, 1, aoi.Position{}},
+}
+
+type pair struct {
+	watcher int64
+	target  int64
+}
+
+type world struct {
+	opts      Options
+	positions map[int64]aoi.Position
+}
+
+func (w *world) cluster(pos aoi.Position) int {
+	return int(math.Floor(float64(pos.X)/clusterGap))*1000 + int(math.Floor(float64(pos.Y)/clusterGap))
+}
+
+func (w *world) visible() map[pair]struct{} {
+	result := make(map[pair]struct{})
+	for a, pa := range w.positions {
+		for b, pb := range w.positions {
+			if a == b {
+				continue
+			}
+			if w.opts.Unbounded || w.cluster(pa) == w.cluster(pb) {
+				result[pair{a, b}] = struct{}{}
+			}
+		}
+	}
+	return result
+}
+
+// RunConformance newScene每次需要返回一个全新的场景，且满足"同簇可见、异簇不可见"
+// 实现了aoi.Flusher的场景会在每一步之后调用Flush
+func RunConformance(t *testing.T, newScene func() aoi.Scene, opts Options) {
+	t.Helper()
+	t.Run("script", func(t *testing.T) {
+		runScript(t, newScene(), opts)
+	})
+	t.Run("errors", func(t *testing.T) {
+		runErrors(t, newScene())
+	})
+}
+
+func runScript(t *testing.T, scene aoi.Scene, opts Options) {
+	var events []aoi.Event
+	listener := aoi.ListenerFunc(func(ev aoi.Event) {
+		events = append(events, ev)
+	})
+	w := &world{opts: opts, positions: make(map[int64]aoi.Position)}
+
+	for i, st := range script {
+		before := w.visible()
+		events = events[:0]
+
+		var err error
+		switch st.kind {
+		case stepEnter:
+			err = scene.Enter(st.id, st.pos, listener)
+			w.positions[st.id] = st.pos
+		case stepMove:
+			err = scene.Move(st.id, st.pos)
+			w.positions[st.id] = st.pos
+		case stepLeave:
+			err = scene.Leave(st.id)
+			delete(w.positions, st.id)
+		}
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		// 批量模式的场景每一步都当做一帧
+		if f, ok := scene.(aoi.Flusher); ok {
+			f.Flush()
+		}
+		after := w.visible()
+
+		expectEnter, expectLeave := make(map[pair]struct{}), make(map[pair]struct{})
+		for p := range after {
+			if _, ok := before[p]; !ok {
+				expectEnter[p] = struct{}{}
+			}
+		}
+		for p := range before {
+			if _, ok := after[p]; ok {
+				continue
+			}
+			// 已经离开场景的Entity不再关心任何事件
+			if _, ok := w.positions[p.watcher]; ok {
+				expectLeave[p] = struct{}{}
+			}
+		}
+
+		gotEnter, gotLeave := make(map[pair]struct{}), make(map[pair]struct{})
+		for _, ev := range events {
+			p := pair{ev.WatcherId, ev.TargetId}
+			if _, ok := w.positions[ev.WatcherId]; !ok {
+				continue
+			}
+			switch ev.Type {
+			case aoi.EventEnter, aoi.EventSync:
+				gotEnter[p] = struct{}{}
+			case aoi.EventLeave:
+				gotLeave[p] = struct{}{}
+			case aoi.EventMove:
+				if _, ok := after[p]; !ok {
+					t.Fatalf("step %d: %d received move of invisible %d", i, p.watcher, p.target)
+				}
+				if ev.Position != w.positions[p.target] {
+					t.Fatalf("step %d: move event position %+v, expect %+v", i, ev.Position, w.positions[p.target])
+				}
+			}
+		}
+		if !samePairs(gotEnter, expectEnter) {
+			t.Fatalf("step %d: enter events %v, expect %v", i, sortPairs(gotEnter), sortPairs(expectEnter))
+		}
+		if !samePairs(gotLeave, expectLeave) {
+			t.Fatalf("step %d: leave events %v, expect %v", i, sortPairs(gotLeave), sortPairs(expectLeave))
+		}
+
+		for id := range w.positions {
+			got := scene.Visible(id)
+			sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+			var expect []int64
+			for p := range after {
+				if p.watcher == id {
+					expect = append(expect, p.target)
+				}
+			}
+			sort.Slice(expect, func(i, j int) bool { return expect[i] < expect[j] })
+			if !sameIds(got, expect) {
+				t.Fatalf("step %d: visible of %d is %v, expect %v", i, id, got, expect)
+			}
+		}
+	}
+}
+
+func runErrors(t *testing.T, scene aoi.Scene) {
+	if err := scene.Enter(1, aoi.Position{X: 1, Y: 1}, nil); err != nil {
+		t.Fatalf("enter: %v", err)
+	}
+	if err := scene.Enter(1, aoi.Position{X: 1, Y: 1}, nil); !errors.Is(err, aoi.ErrEntityExists) {
+		t.Fatalf("enter twice: %v", err)
+	}
+	if err := scene.Move(2, aoi.Position{}); !errors.Is(err, aoi.ErrEntityNotFound) {
+		t.Fatalf("move unknown: %v", err)
+	}
+	if err := scene.Leave(2); !errors.Is(err, aoi.ErrEntityNotFound) {
+		t.Fatalf("leave unknown: %v", err)
+	}
+	if err := scene.Leave(1); err != nil {
+		t.Fatalf("leave: %v", err)
+	}
+	if got := scene.Visible(1); len(got) != 0 {
+		t.Fatalf("visible after leave: %v", got)
+	}
+}
+
+func samePairs(a, b map[pair]struct{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for p := range a {
+		if _, ok := b[p]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func sortPairs(m map[pair]struct{}) (result []pair) {
+	for p := range m {
+		result = append(result, p)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].watcher != result[j].watcher {
+			return result[i].watcher < result[j].watcher
+		}
+		return result[i].target < result[j].target
+	})
+	return
+}
+
+func sameIds(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
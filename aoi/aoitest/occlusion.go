@@ -0,0 +1,222 @@
+package aoitest
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"game-toolkit/aoi"
+)
+
+// occlusionScene 同时支持遮挡的场景
+type occlusionScene interface {
+	aoi.Scene
+	aoi.OcclusionScene
+}
+
+// RunOcclusion 检查墙和门挡住视线、开关门时重新计算可见关系，以及随机操作之后可见集合等于几何上可见且视线不被遮挡
+// newScene返回的场景需要实现aoi.OcclusionScene，坐标差都小于clusterSpan的Entity互相可见，不能开启防抖
+func RunOcclusion(t *testing.T, newScene func() aoi.Scene) {
+	t.Helper()
+	t.Run("door", func(t *testing.T) {
+		runDoor(t, newScene())
+	})
+	t.Run("random", func(t *testing.T) {
+		// 没有遮挡物的同一种场景作为几何上可见的参照
+		runOcclusionRandom(t, newScene(), newScene())
+	})
+}
+
+func runDoor(t *testing.T, inner aoi.Scene) {
+	scene, ok := inner.(occlusionScene)
+	if !ok {
+		t.Fatalf("%T does not support occlusion", inner)
+	}
+	var events []aoi.Event
+	listener := aoi.ListenerFunc(func(ev aoi.Event) {
+		events = append(events, ev)
+	})
+	step := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f, ok := scene.(aoi.Flusher); ok {
+			f.Flush()
+		}
+	}
+	expect := func(watcher int64, targets ...int64) {
+		t.Helper()
+		got := scene.Visible(watcher)
+		sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+		if !sameIds(got, targets) {
+			t.Fatalf("visible of %d is %v, expect %v", watcher, got, targets)
+		}
+	}
+
+	// x=5上的一堵墙，下面一段是门，1在墙左边，2在墙右边，3在门左边
+	wall := aoi.Segment{A: aoi.Position{X: 5, Y: 4}, B: aoi.Position{X: 5, Y: 8}}
+	door := aoi.Segment{A: aoi.Position{X: 5, Y: 0}, B: aoi.Position{X: 5, Y: 4}}
+	scene.AddOccluder(1, wall)
+	scene.AddOccluder(2, door)
+	step(scene.Enter(1, aoi.Position{X: 1, Y: 5}, listener))
+	step(scene.Enter(2, aoi.Position{X: 7.5, Y: 5}, listener))
+	step(scene.Enter(3, aoi.Position{X: 4, Y: 1}, listener))
+	expect(1, 3)
+	expect(2)
+	expect(3, 1)
+
+	// 开门之后3和2隔着门口互相看到，1和2之间还是墙
+	events = nil
+	step(scene.SetOccluderEnabled(2, false))
+	expect(2, 3)
+	expect(3, 1, 2)
+	expect(1, 3)
+	if len(events) != 2 {
+		t.Fatalf("open door should only notify 2 and 3: %v", events)
+	}
+	// 状态没有变化时不重新计算
+	events = nil
+	step(scene.SetOccluderEnabled(2, false))
+	if len(events) != 0 {
+		t.Fatalf("opening an open door: %v", events)
+	}
+
+	// 在视野范围内移动也会被墙挡住或者绕出来
+	step(scene.Move(2, aoi.Position{X: 7.5, Y: 1}))
+	expect(1, 2, 3)
+	step(scene.Move(2, aoi.Position{X: 7.5, Y: 6}))
+	expect(1, 3)
+	step(scene.Move(2, aoi.Position{X: 7.5, Y: 1}))
+
+	// 关门之后2谁都看不到
+	step(scene.SetOccluderEnabled(2, true))
+	expect(1, 3)
+	expect(2)
+	expect(3, 1)
+
+	// 替换遮挡物时，原来的位置和新的位置都要重新计算
+	step(scene.Move(2, aoi.Position{X: 7.5, Y: 6}))
+	expect(2)
+	scene.AddOccluder(1, aoi.Segment{A: aoi.Position{X: 50, Y: 50}, B: aoi.Position{X: 60, Y: 50}})
+	expect(1, 2, 3)
+	scene.AddOccluder(1, wall)
+	expect(1, 3)
+	step(scene.RemoveOccluder(1))
+	expect(1, 2, 3)
+
+	if err := scene.RemoveOccluder(1); !errors.Is(err, aoi.ErrOccluderNotFound) {
+		t.Fatalf("remove missing occluder: %v", err)
+	}
+	if err := scene.SetOccluderEnabled(1, true); !errors.Is(err, aoi.ErrOccluderNotFound) {
+		t.Fatalf("toggle missing occluder: %v", err)
+	}
+}
+
+func runOcclusionRandom(t *testing.T, inner, reference aoi.Scene) {
+	scene, ok := inner.(occlusionScene)
+	if !ok {
+		t.Fatalf("%T does not support occlusion", inner)
+	}
+	occluders := aoi.NewOccluders(0) // 和场景里的遮挡物保持一致，用来计算期望的结果
+	visible := make(map[int64]map[int64]struct{})
+	var failed string
+	listener := aoi.ListenerFunc(func(ev aoi.Event) {
+		set := visible[ev.WatcherId]
+		_, ok := set[ev.TargetId]
+		switch ev.Type {
+		case aoi.EventEnter, aoi.EventSync:
+			if ok {
+				failed = "duplicate enter"
+			}
+			set[ev.TargetId] = struct{}{}
+		case aoi.EventLeave:
+			if !ok {
+				failed = "leave of invisible target"
+			}
+			delete(set, ev.TargetId)
+		case aoi.EventMove:
+			if !ok {
+				failed = "move of invisible target"
+			}
+		}
+	})
+	flush := func() {
+		for _, s := range []aoi.Scene{scene, reference} {
+			if f, ok := s.(aoi.Flusher); ok {
+				f.Flush()
+			}
+		}
+	}
+
+	positions := make(map[int64]aoi.Position)
+	rnd := rand.New(rand.NewSource(1))
+	randomPos := func() aoi.Position {
+		return aoi.Position{X: float32(rnd.Intn(4*clusterSpan)) / 4, Y: float32(rnd.Intn(4*clusterSpan)) / 4}
+	}
+	for i := 0; i < 400; i++ {
+		id := int64(rnd.Intn(10) + 1)
+		_, in := positions[id]
+		var err error
+		switch op := rnd.Intn(10); {
+		case op == 0:
+			// 随机的墙
+			occluder := rnd.Intn(4) + 1
+			seg := aoi.Segment{A: randomPos(), B: randomPos()}
+			occluders.Add(occluder, seg)
+			scene.AddOccluder(occluder, seg)
+		case op == 1:
+			occluder, enabled := rnd.Intn(4)+1, rnd.Intn(2) == 0
+			_, _, want := occluders.SetEnabled(occluder, enabled)
+			if err = scene.SetOccluderEnabled(occluder, enabled); err != want {
+				t.Fatalf("step %d: toggle occluder %d: %v, expect %v", i, occluder, err, want)
+			}
+			err = nil
+		case !in:
+			visible[id] = make(map[int64]struct{})
+			positions[id] = randomPos()
+			reference.Enter(id, positions[id], nil)
+			err = scene.Enter(id, positions[id], listener)
+		case op == 2:
+			reference.Leave(id)
+			err = scene.Leave(id)
+			delete(positions, id)
+			delete(visible, id)
+		default:
+			positions[id] = randomPos()
+			reference.Move(id, positions[id])
+			err = scene.Move(id, positions[id])
+		}
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		flush()
+		if failed != "" {
+			t.Fatalf("step %d: %s", i, failed)
+		}
+
+		for watcher, wp := range positions {
+			var expect []int64
+			for _, target := range reference.Visible(watcher) {
+				if !occluders.Blocked(wp, positions[target]) {
+					expect = append(expect, target)
+				}
+			}
+			sort.Slice(expect, func(i, j int) bool { return expect[i] < expect[j] })
+			got := scene.Visible(watcher)
+			sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+			if !sameIds(got, expect) {
+				t.Fatalf("step %d: visible of %d is %v, expect %v", i, watcher, got, expect)
+			}
+			var tracked []int64
+			for target := range visible[watcher] {
+				tracked = append(tracked, target)
+			}
+			sort.Slice(tracked, func(i, j int) bool { return tracked[i] < tracked[j] })
+			if !sameIds(tracked, expect) {
+				t.Fatalf("step %d: events of %d lead to %v, expect %v", i, watcher, tracked, expect)
+			}
+		}
+	}
+}
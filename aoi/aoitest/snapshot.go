@@ -0,0 +1,136 @@
+package aoitest
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"game-toolkit/aoi"
+)
+
+// RunSnapshot newScene返回的场景需要实现aoi.Snapshotter，并且满足"同簇可见、异簇不可见"
+// 导出快照并经过JSON编解码之后恢复到新的场景，检查可见关系和之后产生的事件都和原场景一致
+func RunSnapshot(t *testing.T, newScene func() aoi.Scene) {
+	t.Helper()
+	var events []aoi.Event
+	listener := aoi.ListenerFunc(func(ev aoi.Event) {
+		events = append(events, ev)
+	})
+	listenerOf := func(id int64) aoi.Listener { return listener }
+	flush := func(scene aoi.Scene) {
+		if f, ok := scene.(aoi.Flusher); ok {
+			f.Flush()
+		}
+	}
+
+	origin := newScene()
+	for _, st := range script[:8] {
+		var err error
+		switch st.kind {
+		case stepEnter:
+			err = origin.Enter(st.id, st.pos, listener)
+		case stepMove:
+			err = origin.Move(st.id, st.pos)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 隐身的Entity恢复之后仍然隐身
+	if vs, ok := origin.(aoi.VisibilityScene); ok {
+		if err := vs.SetVisibility(5, aoi.Visibility{Mask: aoi.LayerDefault}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flush(origin)
+
+	snap := origin.(aoi.Snapshotter).Snapshot()
+	data, err := json.Marshal(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded aoi.Snapshot
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(snap, decoded) {
+		t.Fatalf("json round trip changed snapshot: %+v, %+v", snap, decoded)
+	}
+
+	// 静默恢复不发送任何事件
+	restored := newScene()
+	events = nil
+	if err := restored.(aoi.Snapshotter).Restore(decoded, listenerOf, false); err != nil {
+		t.Fatal(err)
+	}
+	flush(restored)
+	if len(events) != 0 {
+		t.Fatalf("silent restore should not emit events: %+v", events)
+	}
+	if again := restored.(aoi.Snapshotter).Snapshot(); !reflect.DeepEqual(snap, again) {
+		t.Fatalf("snapshot of restored scene %+v, expect %+v", again, snap)
+	}
+	visiblePairs := 0
+	for _, es := range snap.Entities {
+		got, expect := sortedVisible(restored, es.Id), sortedVisible(origin, es.Id)
+		if !sameIds(got, expect) {
+			t.Fatalf("visible of %d is %v after restore, expect %v", es.Id, got, expect)
+		}
+		visiblePairs += len(expect)
+	}
+
+	// 恢复之后两个场景对同样的操作产生同样的事件
+	for _, st := range script[8:] {
+		var results [2][]string
+		for i, scene := range []aoi.Scene{origin, restored} {
+			events = nil
+			switch st.kind {
+			case stepEnter:
+				err = scene.Enter(st.id, st.pos, listener)
+			case stepMove:
+				err = scene.Move(st.id, st.pos)
+			case stepLeave:
+				err = scene.Leave(st.id)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			flush(scene)
+			for _, ev := range events {
+				b, _ := json.Marshal(ev)
+				results[i] = append(results[i], string(b))
+			}
+			sort.Strings(results[i])
+		}
+		if !reflect.DeepEqual(results[0], results[1]) {
+			t.Fatalf("events after restore %v, expect %v", results[1], results[0])
+		}
+	}
+
+	// 需要通知时，恢复出来的可见关系都以事件的形式发出
+	notified := newScene()
+	events = nil
+	if err := notified.(aoi.Snapshotter).Restore(decoded, listenerOf, true); err != nil {
+		t.Fatal(err)
+	}
+	flush(notified)
+	if len(events) != visiblePairs {
+		t.Fatalf("notify restore should emit %d events, got %+v", visiblePairs, events)
+	}
+
+	// 和场景内已有的id冲突时整体失败
+	if err := notified.(aoi.Snapshotter).Restore(decoded, nil, false); !errors.Is(err, aoi.ErrEntityExists) {
+		t.Fatalf("restore twice: %v", err)
+	}
+	if again := notified.(aoi.Snapshotter).Snapshot(); !reflect.DeepEqual(snap, again) {
+		t.Fatalf("failed restore should not change the scene")
+	}
+}
+
+func sortedVisible(scene aoi.Scene, id int64) []int64 {
+	result := scene.Visible(id)
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
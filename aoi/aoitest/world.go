@@ -0,0 +1,146 @@
+package aoitest
+
+import (
+	"errors"
+	"testing"
+
+	"game-toolkit/aoi"
+)
+
+// RunWorld 用两个相邻的区域组成aoi.World，检查边界两侧互相可见、切换区域时没有闪烁
+// newScene返回的场景需要是无限大的地图，坐标差都小于clusterSpan的Entity互相可见，坐标差超过3*clusterSpan的互相不可见
+func RunWorld(t *testing.T, newScene func() aoi.Scene) {
+	t.Helper()
+	const border = 5
+	// 区域1是[0, 100)，区域2是[100, 200)
+	world := aoi.NewWorld(border)
+	if err := world.AddZone(1, aoi.Position{}, aoi.Position{X: 100, Y: 100}, newScene()); err != nil {
+		t.Fatal(err)
+	}
+	if err := world.AddZone(2, aoi.Position{X: 100}, aoi.Position{X: 200, Y: 100}, newScene()); err != nil {
+		t.Fatal(err)
+	}
+	if err := world.AddZone(1, aoi.Position{}, aoi.Position{}, newScene()); !errors.Is(err, aoi.ErrZoneExists) {
+		t.Fatalf("add zone twice: %v", err)
+	}
+
+	var events []aoi.Event
+	listener := aoi.ListenerFunc(func(ev aoi.Event) {
+		events = append(events, ev)
+	})
+	count := func(watcher int64, category aoi.EventType) (n int) {
+		for _, ev := range events {
+			if ev.WatcherId == watcher && ev.Type == category {
+				n++
+			}
+		}
+		return
+	}
+	flicker := func(watcher int64) bool {
+		return count(watcher, aoi.EventEnter)+count(watcher, aoi.EventSync)+count(watcher, aoi.EventLeave) != 0
+	}
+	visible := func(watcher, target int64) bool {
+		for _, id := range world.Visible(watcher) {
+			if id == target {
+				return true
+			}
+		}
+		return false
+	}
+	step := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		world.Flush()
+	}
+
+	// 边界两侧的1和2通过影子互相看到，5离边界较远，只在区域1
+	step(world.Enter(1, aoi.Position{X: 95, Y: 50}, listener))
+	step(world.Enter(2, aoi.Position{X: 101, Y: 50}, listener))
+	step(world.Enter(5, aoi.Position{X: 93.5, Y: 50}, listener))
+	if !visible(1, 2) || !visible(2, 1) || !visible(1, 5) || visible(2, 5) {
+		t.Fatalf("entities near the border should see each other")
+	}
+	if zoneId, _ := world.Owner(2); zoneId != 2 {
+		t.Fatalf("entity 2 should belong to zone 2, got %d", zoneId)
+	}
+
+	// 1走过边界之后才能切换区域
+	if err := world.Transfer(1, 2); !errors.Is(err, aoi.ErrOutOfBounds) {
+		t.Fatalf("transfer before crossing the border: %v", err)
+	}
+
+	// 1在边界附近切换区域，2和5都不会收到leave/enter，1自己丢掉只在区域1里的5
+	events = nil
+	step(world.Move(1, aoi.Position{X: 100.5, Y: 50}))
+	step(world.Move(1, aoi.Position{X: 101, Y: 50}))
+	step(world.Transfer(1, 2))
+	if flicker(2) || flicker(5) || count(2, aoi.EventMove) != 2 || count(5, aoi.EventMove) != 2 {
+		t.Fatalf("observers should only see moves: %+v", events)
+	}
+	if count(1, aoi.EventLeave) != 1 || count(1, aoi.EventSync) != 0 || visible(1, 5) || !visible(1, 2) {
+		t.Fatalf("transferred entity should switch its view: %+v", events)
+	}
+	if zoneId, _ := world.Owner(1); zoneId != 2 {
+		t.Fatalf("entity 1 should belong to zone 2, got %d", zoneId)
+	}
+	if !visible(5, 1) {
+		t.Fatalf("zone 1 should keep a ghost of entity 1")
+	}
+
+	// 1走远之后区域1里的影子离开，5收到leave
+	events = nil
+	step(world.Move(1, aoi.Position{X: 150, Y: 50}))
+	if count(5, aoi.EventLeave) != 1 || count(2, aoi.EventLeave) != 1 || count(1, aoi.EventLeave) != 1 {
+		t.Fatalf("moving away from the border should drop the ghost: %+v", events)
+	}
+
+	// 走回区域1深处再切换，旧区域里不留影子，新区域里的视野是空的
+	events = nil
+	if err := world.Transfer(1, 1); !errors.Is(err, aoi.ErrOutOfBounds) {
+		t.Fatalf("transfer to a zone not containing the entity: %v", err)
+	}
+	step(world.Move(1, aoi.Position{X: 50, Y: 50}))
+	step(world.Transfer(1, 1))
+	if zoneId, _ := world.Owner(1); zoneId != 1 || count(1, aoi.EventLeave) != 0 || visible(1, 5) {
+		t.Fatalf("transfer far from the border: %+v", events)
+	}
+	step(world.Transfer(1, 1))
+
+	step(world.Move(5, aoi.Position{X: 60, Y: 50}))
+	events = nil
+	step(world.Leave(2))
+	if count(1, aoi.EventLeave)+count(5, aoi.EventLeave) != 0 {
+		t.Fatalf("no one should see entity 2 leave: %+v", events)
+	}
+	if err := world.Transfer(1, 3); !errors.Is(err, aoi.ErrZoneNotFound) {
+		t.Fatalf("transfer to unknown zone: %v", err)
+	}
+	if err := world.Enter(3, aoi.Position{X: 300}, listener); !errors.Is(err, aoi.ErrOutOfBounds) {
+		t.Fatalf("enter outside zones: %v", err)
+	}
+	if err := world.Enter(1, aoi.Position{}, listener); !errors.Is(err, aoi.ErrEntityExists) {
+		t.Fatalf("enter twice: %v", err)
+	}
+	step(world.Leave(1))
+	step(world.Leave(5))
+	if err := world.Leave(1); !errors.Is(err, aoi.ErrEntityNotFound) {
+		t.Fatalf("leave twice: %v", err)
+	}
+
+	// 批量模式下Move之后不Flush直接切换区域，新区域里缓存的发给影子的sync不能在切换之后再发给Entity一次
+	world = aoi.NewWorld(border)
+	world.AddZone(1, aoi.Position{}, aoi.Position{X: 100, Y: 100}, newScene())
+	world.AddZone(2, aoi.Position{X: 100}, aoi.Position{X: 200, Y: 100}, newScene())
+	step(world.Enter(1, aoi.Position{X: 80, Y: 50}, listener))
+	step(world.Enter(2, aoi.Position{X: 106, Y: 50}, listener))
+	events = nil
+	if err := world.Move(1, aoi.Position{X: 100.5, Y: 50}); err != nil {
+		t.Fatal(err)
+	}
+	step(world.Transfer(1, 2))
+	if count(1, aoi.EventEnter)+count(1, aoi.EventSync) != 1 || count(2, aoi.EventEnter)+count(2, aoi.EventSync) != 1 {
+		t.Fatalf("transfer right after a move should enter once: %+v", events)
+	}
+}
@@ -0,0 +1,117 @@
+package aoi
+
+/*
+	[思路]
+	人多的地方每次移动都会给视野内的所有Entity发事件，一帧内会产生大量零碎的小消息。
+	开启批量模式后，场景把事件按Watcher缓存在EventBuffer里，帧末调用Flush时每个Watcher只收到一个Batch。
+	同一个Target在一帧内的多个事件会合并成净效果:
+	帧初不可见、帧末可见 -> enter；帧初可见、帧末不可见 -> leave；帧初帧末都可见 -> 只保留最后位置的move；
+	帧初帧末都不可见(进来又出去了) -> 什么都不发
+*/
+
+type Batch struct {
+	WatcherId int64
+	Enters    []Event // EventEnter or EventSync
+	Leaves    []Event
+	Moves     []Event
+}
+
+func (b Batch) Empty() bool {
+	return len(b.Enters) == 0 && len(b.Leaves) == 0 && len(b.Moves) == 0
+}
+
+// BatchListener Listener可以额外实现该接口，一次性接收整个Batch，否则Batch会被拆成单个事件投递
+type BatchListener interface {
+	OnBatch(b Batch)
+}
+
+// Flusher 支持批量模式的场景实现该接口，通常在每帧末尾调用
+type Flusher interface {
+	Flush()
+}
+
+// DeliverBatch 把Batch投递给listener，拆成单个事件时按leave、enter、move的顺序投递
+func DeliverBatch(listener Listener, b Batch) {
+	if listener == nil || b.Empty() {
+		return
+	}
+	if bl, ok := listener.(BatchListener); ok {
+		bl.OnBatch(b)
+		return
+	}
+	for _, events := range [][]Event{b.Leaves, b.Enters, b.Moves} {
+		for _, ev := range events {
+			listener.OnEvent(ev)
+		}
+	}
+}
+
+type targetState struct {
+	first Event // 本帧内关于该Target的第一个事件
+	last  Event // 本帧内关于该Target的最后一个事件
+}
+
+type watcherBuffer struct {
+	targets map[int64]*targetState
+	order   []int64 // 保证同一帧内Target的顺序稳定
+}
+
+// EventBuffer 按Watcher缓存事件，非并发安全，由场景自己加锁
+type EventBuffer struct {
+	watchers map[int64]*watcherBuffer
+	order    []int64
+}
+
+func NewEventBuffer() *EventBuffer {
+	return &EventBuffer{watchers: make(map[int64]*watcherBuffer)}
+}
+
+func (b *EventBuffer) Add(ev Event) {
+	wb, ok := b.watchers[ev.WatcherId]
+	if !ok {
+		wb = &watcherBuffer{targets: make(map[int64]*targetState)}
+		b.watchers[ev.WatcherId] = wb
+		b.order = append(b.order, ev.WatcherId)
+	}
+	ts, ok := wb.targets[ev.TargetId]
+	if !ok {
+		wb.targets[ev.TargetId] = &targetState{first: ev, last: ev}
+		wb.order = append(wb.order, ev.TargetId)
+		return
+	}
+	ts.last = ev
+}
+
+// Drain 取出所有Watcher合并后的Batch并清空缓存
+func (b *EventBuffer) Drain() (result []Batch) {
+	for _, watcherId := range b.order {
+		wb := b.watchers[watcherId]
+		batch := Batch{WatcherId: watcherId}
+		for _, targetId := range wb.order {
+			ts := wb.targets[targetId]
+			visibleBefore := ts.first.Type == EventLeave || ts.first.Type == EventMove
+			visibleAfter := ts.last.Type != EventLeave
+			ev := ts.last
+			switch {
+			case !visibleBefore && visibleAfter:
+				ev.Type = ts.first.Type
+				batch.Enters = append(batch.Enters, ev)
+			case visibleBefore && !visibleAfter:
+				batch.Leaves = append(batch.Leaves, ev)
+			case visibleBefore && visibleAfter:
+				ev.Type = EventMove
+				batch.Moves = append(batch.Moves, ev)
+			}
+		}
+		if !batch.Empty() {
+			result = append(result, batch)
+		}
+	}
+	b.watchers = make(map[int64]*watcherBuffer)
+	b.order = nil
+	return
+}
+
+func (b *EventBuffer) Len() int {
+	return len(b.order)
+}
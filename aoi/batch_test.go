@@ -0,0 +1,43 @@
+package aoi
+
+import "testing"
+
+func TestEventBuffer(t *testing.T) {
+	b := NewEventBuffer()
+	pos := func(x float32) Position { return Position{X: x} }
+
+	// target 2: 帧初可见，移动多次 -> 只保留最后一次move
+	b.Add(Event{Type: EventMove, WatcherId: 1, TargetId: 2, Position: pos(1)})
+	b.Add(Event{Type: EventMove, WatcherId: 1, TargetId: 2, Position: pos(2)})
+	b.Add(Event{Type: EventMove, WatcherId: 1, TargetId: 2, Position: pos(3)})
+	// target 3: 进入后移动 -> enter，位置为最后的位置
+	b.Add(Event{Type: EventEnter, WatcherId: 1, TargetId: 3, Position: pos(1)})
+	b.Add(Event{Type: EventMove, WatcherId: 1, TargetId: 3, Position: pos(5)})
+	// target 4: 进来又出去 -> 什么都不发
+	b.Add(Event{Type: EventSync, WatcherId: 1, TargetId: 4, Position: pos(1)})
+	b.Add(Event{Type: EventLeave, WatcherId: 1, TargetId: 4, Position: pos(2)})
+	// target 5: 移动后离开 -> leave
+	b.Add(Event{Type: EventMove, WatcherId: 1, TargetId: 5, Position: pos(1)})
+	b.Add(Event{Type: EventLeave, WatcherId: 1, TargetId: 5, Position: pos(2)})
+	// watcher 6 的事件只有进来又出去
+	b.Add(Event{Type: EventEnter, WatcherId: 6, TargetId: 1, Position: pos(1)})
+	b.Add(Event{Type: EventLeave, WatcherId: 6, TargetId: 1, Position: pos(1)})
+
+	batches := b.Drain()
+	if len(batches) != 1 {
+		t.Fatalf("expect 1 batch, got %+v", batches)
+	}
+	batch := batches[0]
+	if len(batch.Moves) != 1 || batch.Moves[0].TargetId != 2 || batch.Moves[0].Position != pos(3) {
+		t.Fatalf("unexpected moves %+v", batch.Moves)
+	}
+	if len(batch.Enters) != 1 || batch.Enters[0].TargetId != 3 || batch.Enters[0].Type != EventEnter || batch.Enters[0].Position != pos(5) {
+		t.Fatalf("unexpected enters %+v", batch.Enters)
+	}
+	if len(batch.Leaves) != 1 || batch.Leaves[0].TargetId != 5 {
+		t.Fatalf("unexpected leaves %+v", batch.Leaves)
+	}
+	if b.Len() != 0 || len(b.Drain()) != 0 {
+		t.Fatalf("buffer should be empty after drain")
+	}
+}
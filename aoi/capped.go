@@ -0,0 +1,371 @@
+package aoi
+
+import (
+	"sort"
+	"sync"
+)
+
+/*
+	[思路]
+	主城里几百个玩家挤在同一片视野内，客户端根本渲染不过来。CappedScene包装任意一个Scene，
+	内部场景算出的可见集合只作为候选，每个Watcher只保留优先级最高的limit个，
+	优先级由Priority计算，可以综合距离、队伍、敌对关系、最近交互等，依赖的外部状态变化后调用Refresh
+	候选集合或者优先级变化时，Entity在保留集合里换进换出，对外发送enter/leave，保留集合里的Entity照常收到move
+	Target移动只会改变它自己的优先级，和保留集合里最低的、或者候选里最高的交换一次即可，开销和候选数量成正比；
+	Watcher自己移动时它看到的所有优先级都变了，整体重新排序
+	内部场景开启了批量模式时，CappedScene在Flush时才收到事件，再按leave、enter、move的顺序逐个转发
+*/
+
+// Priority 返回watcher视角下target的优先级，值越大越优先留在可见集合里
+// 在CappedScene的锁内调用，不能再调用场景的方法
+type Priority func(watcher, target int64, watcherPos, targetPos Position) float64
+
+// DistancePriority 默认的优先级，距离越近越优先
+func DistancePriority(watcher, target int64, watcherPos, targetPos Position) float64 {
+	dx := float64(watcherPos.X) - float64(targetPos.X)
+	dy := float64(watcherPos.Y) - float64(targetPos.Y)
+	dz := float64(watcherPos.Z) - float64(targetPos.Z)
+	return -(dx*dx + dy*dy + dz*dz)
+}
+
+type CappedScene struct {
+	sync.Mutex
+	scene      Scene
+	limit      int
+	priority   Priority
+	entities   map[int64]*cappedEntity
+	dispatcher Dispatcher // 本次调用产生的事件，释放锁之后再投递
+}
+
+type cappedEntity struct {
+	id         int64
+	pos        Position
+	listener   Listener
+	candidates map[int64]*candidate // 内部场景里我能看到的
+	selected   int                  // 保留下来的候选数量
+	observers  map[int64]struct{}   // 内部场景里能看到我的
+	leaving    bool                 // 正在离开，内部场景在Leave里发给我的事件不再处理
+}
+
+type candidate struct {
+	id       int64
+	pos      Position
+	priority float64
+	selected bool
+}
+
+var (
+	_ Scene           = (*CappedScene)(nil)
+	_ Flusher         = (*CappedScene)(nil)
+	_ VisibilityScene = (*CappedScene)(nil)
+)
+
+// NewCappedScene 包装scene，每个Watcher最多保留limit个可见的Entity，limit<=0时不限制，priority为nil时使用DistancePriority
+// scene只能通过CappedScene访问，否则保留集合和内部场景会对不上
+func NewCappedScene(scene Scene, limit int, priority Priority) *CappedScene {
+	if priority == nil {
+		priority = DistancePriority
+	}
+	return &CappedScene{
+		scene:    scene,
+		limit:    limit,
+		priority: priority,
+		entities: make(map[int64]*cappedEntity),
+	}
+}
+
+func (s *CappedScene) Enter(id int64, pos Position, listener Listener) error {
+	s.Lock()
+	if _, ok := s.entities[id]; ok {
+		s.Unlock()
+		return ErrEntityExists
+	}
+	s.entities[id] = &cappedEntity{
+		id:         id,
+		pos:        pos,
+		listener:   listener,
+		candidates: make(map[int64]*candidate),
+		observers:  make(map[int64]struct{}),
+	}
+	s.Unlock()
+
+	// 内部场景同步已有Entity的sync事件会在Enter返回前回调onEvent
+	if err := s.scene.Enter(id, pos, ListenerFunc(s.onEvent)); err != nil {
+		s.Lock()
+		delete(s.entities, id)
+		s.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (s *CappedScene) Leave(id int64) error {
+	s.Lock()
+	e, ok := s.entities[id]
+	if !ok || e.leaving {
+		s.Unlock()
+		return ErrEntityNotFound
+	}
+	// 有的内部场景离开时会给自己发leave，不能再从候选里补上新的enter
+	e.leaving = true
+	s.Unlock()
+	if err := s.scene.Leave(id); err != nil {
+		s.Lock()
+		e.leaving = false
+		s.Unlock()
+		return err
+	}
+
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	delete(s.entities, id)
+	for targetId := range e.candidates {
+		if target, ok := s.entities[targetId]; ok {
+			delete(target.observers, id)
+		}
+	}
+	return nil
+}
+
+func (s *CappedScene) Move(id int64, pos Position) error {
+	s.Lock()
+	e, ok := s.entities[id]
+	if !ok || e.leaving {
+		s.Unlock()
+		return ErrEntityNotFound
+	}
+	old := e.pos
+	e.pos = pos
+	s.Unlock()
+
+	if err := s.scene.Move(id, pos); err != nil {
+		s.Lock()
+		e.pos = old
+		s.Unlock()
+		return err
+	}
+
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	if _, ok := s.entities[id]; ok {
+		s.rerank(e, EventSync)
+	}
+	return nil
+}
+
+// Visible 获取id保留下来的可见Entity
+func (s *CappedScene) Visible(id int64) (result []int64) {
+	s.Lock()
+	defer s.Unlock()
+	e, ok := s.entities[id]
+	if !ok {
+		return
+	}
+	for targetId, c := range e.candidates {
+		if c.selected {
+			result = append(result, targetId)
+		}
+	}
+	return
+}
+
+// Flush 内部场景支持批量模式时，把它缓存的事件投递过来
+func (s *CappedScene) Flush() {
+	if f, ok := s.scene.(Flusher); ok {
+		f.Flush()
+	}
+}
+
+// SetVisibility 转发给内部场景，可见关系的变化以事件的形式回到CappedScene
+func (s *CappedScene) SetVisibility(id int64, v Visibility) error {
+	vs, ok := s.scene.(VisibilityScene)
+	if !ok {
+		return ErrNotSupported
+	}
+	return vs.SetVisibility(id, v)
+}
+
+// Refresh 优先级或者Filter依赖的外部状态变化后，重新计算id看到的和看到id的保留集合
+func (s *CappedScene) Refresh(id int64) error {
+	s.Lock()
+	e, ok := s.entities[id]
+	s.Unlock()
+	if !ok || e.leaving {
+		return ErrEntityNotFound
+	}
+	if vs, ok := s.scene.(VisibilityScene); ok {
+		if err := vs.Refresh(id); err != nil {
+			return err
+		}
+	}
+
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	if _, ok := s.entities[id]; !ok {
+		return nil
+	}
+	s.rerank(e, EventEnter)
+	for watcherId := range e.observers {
+		watcher := s.entities[watcherId]
+		if watcher.leaving {
+			continue
+		}
+		c := watcher.candidates[id]
+		c.priority = s.priority(watcherId, id, watcher.pos, c.pos)
+		s.reconsider(watcher, c)
+	}
+	return nil
+}
+
+// 内部场景投递过来的事件，更新Watcher的候选集合
+func (s *CappedScene) onEvent(ev Event) {
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	w, ok := s.entities[ev.WatcherId]
+	if !ok || w.leaving {
+		return
+	}
+	switch ev.Type {
+	case EventEnter, EventSync:
+		c := &candidate{id: ev.TargetId, pos: ev.Position}
+		c.priority = s.priority(w.id, c.id, w.pos, c.pos)
+		w.candidates[c.id] = c
+		if target, ok := s.entities[c.id]; ok {
+			target.observers[w.id] = struct{}{}
+		}
+		s.admit(w, c, ev.Type)
+	case EventMove:
+		c, ok := w.candidates[ev.TargetId]
+		if !ok {
+			return
+		}
+		c.pos = ev.Position
+		c.priority = s.priority(w.id, c.id, w.pos, c.pos)
+		if c.selected {
+			s.emit(w, EventMove, c)
+		}
+		s.reconsider(w, c)
+	case EventLeave:
+		c, ok := w.candidates[ev.TargetId]
+		if !ok {
+			return
+		}
+		delete(w.candidates, c.id)
+		if target, ok := s.entities[c.id]; ok {
+			delete(target.observers, w.id)
+		}
+		if c.selected {
+			w.selected--
+			c.pos = ev.Position
+			s.emit(w, EventLeave, c)
+			s.fill(w)
+		}
+	}
+}
+
+// 以下方法均需要持锁调用
+
+func (s *CappedScene) full(w *cappedEntity) bool {
+	return s.limit > 0 && w.selected >= s.limit
+}
+
+// 新的候选: 没满直接保留，满了就和保留集合里最低的比较
+func (s *CappedScene) admit(w *cappedEntity, c *candidate, enterType EventType) {
+	if s.full(w) {
+		worst := s.worstSelected(w)
+		if !better(c, worst) {
+			return
+		}
+		s.deselect(w, worst)
+	}
+	s.choose(w, c, enterType)
+}
+
+// 已有候选的优先级变了，保留的可能被候选里最高的挤掉，没保留的可能挤掉保留集合里最低的
+func (s *CappedScene) reconsider(w *cappedEntity, c *candidate) {
+	if !c.selected {
+		s.admit(w, c, EventEnter)
+		return
+	}
+	if best := s.bestUnselected(w); best != nil && better(best, c) {
+		s.deselect(w, c)
+		s.choose(w, best, EventEnter)
+	}
+}
+
+// 保留集合有空位时，从候选里按优先级补上
+func (s *CappedScene) fill(w *cappedEntity) {
+	for !s.full(w) {
+		best := s.bestUnselected(w)
+		if best == nil {
+			return
+		}
+		s.choose(w, best, EventEnter)
+	}
+}
+
+// 重新计算w看到的所有优先级，按差集发送事件，先leave后enter
+func (s *CappedScene) rerank(w *cappedEntity, enterType EventType) {
+	all := make([]*candidate, 0, len(w.candidates))
+	for _, c := range w.candidates {
+		c.priority = s.priority(w.id, c.id, w.pos, c.pos)
+		all = append(all, c)
+	}
+	if s.limit <= 0 || len(all) <= s.limit {
+		s.fill(w)
+		return
+	}
+	sort.Slice(all, func(i, j int) bool { return better(all[i], all[j]) })
+	for _, c := range all[s.limit:] {
+		if c.selected {
+			s.deselect(w, c)
+		}
+	}
+	for _, c := range all[:s.limit] {
+		if !c.selected {
+			s.choose(w, c, enterType)
+		}
+	}
+}
+
+func (s *CappedScene) choose(w *cappedEntity, c *candidate, enterType EventType) {
+	c.selected = true
+	w.selected++
+	s.emit(w, enterType, c)
+}
+
+func (s *CappedScene) deselect(w *cappedEntity, c *candidate) {
+	c.selected = false
+	w.selected--
+	s.emit(w, EventLeave, c)
+}
+
+func (s *CappedScene) worstSelected(w *cappedEntity) (worst *candidate) {
+	for _, c := range w.candidates {
+		if c.selected && (worst == nil || better(worst, c)) {
+			worst = c
+		}
+	}
+	return
+}
+
+func (s *CappedScene) bestUnselected(w *cappedEntity) (best *candidate) {
+	for _, c := range w.candidates {
+		if !c.selected && (best == nil || better(c, best)) {
+			best = c
+		}
+	}
+	return
+}
+
+func (s *CappedScene) emit(w *cappedEntity, category EventType, c *candidate) {
+	s.dispatcher.Add(w.listener, Event{Type: category, WatcherId: w.id, TargetId: c.id, Position: c.pos})
+}
+
+// 优先级相同时id小的优先，保证结果是确定的
+func better(a, b *candidate) bool {
+	if a.priority != b.priority {
+		return a.priority > b.priority
+	}
+	return a.id < b.id
+}
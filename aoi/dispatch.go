@@ -0,0 +1,59 @@
+package aoi
+
+import "sync"
+
+/*
+	[思路]
+	场景在持锁期间计算可见关系，Listener里很可能会回调场景的方法，所以不能在锁内投递事件
+	各个场景把本次调用产生的事件暂存在Dispatcher里，释放锁之后再按产生的顺序投递
+	批量模式下事件缓存在EventBuffer里，Flush同样在锁内取出Batch、查好Listener，释放锁之后再投递
+*/
+
+type pendingEvent struct {
+	listener Listener
+	ev       Event
+}
+
+// Dispatcher 持锁期间暂存的事件，非并发安全，由场景自己的锁保护
+type Dispatcher struct {
+	pending []pendingEvent
+}
+
+// Add 暂存一个事件，listener为nil时忽略
+func (d *Dispatcher) Add(listener Listener, ev Event) {
+	if listener == nil {
+		return
+	}
+	d.pending = append(d.pending, pendingEvent{listener, ev})
+}
+
+// Reset 丢掉暂存的事件
+func (d *Dispatcher) Reset() {
+	d.pending = nil
+}
+
+// UnlockAndDispatch 释放锁l之后再投递暂存的事件，通常defer调用
+func (d *Dispatcher) UnlockAndDispatch(l sync.Locker) {
+	pending := d.pending
+	d.pending = nil
+	l.Unlock()
+	for _, p := range pending {
+		p.listener.OnEvent(p.ev)
+	}
+}
+
+// FlushBuffer 持锁l取出buffer里合并好的Batch，用listenerOf查找Watcher当前的Listener，释放锁之后再投递
+// listenerOf返回nil时(比如Watcher已经离开场景)不投递
+func FlushBuffer(l sync.Locker, buffer *EventBuffer, listenerOf func(watcherId int64) Listener) {
+	l.Lock()
+	batches := buffer.Drain()
+	listeners := make([]Listener, len(batches))
+	for i, b := range batches {
+		listeners[i] = listenerOf(b.WatcherId)
+	}
+	l.Unlock()
+
+	for i, b := range batches {
+		DeliverBatch(listeners[i], b)
+	}
+}
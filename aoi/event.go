@@ -0,0 +1,58 @@
+package aoi
+
+/*
+	[思路]
+	各AOI实现不直接处理消息内容，而是把结果以类型化的Event投递给Listener，
+	由上层(网络层、游戏逻辑)自行决定如何处理，比如转成协议包下发给客户端
+*/
+
+// Position 世界坐标，和移动模拟使用同样的float32，不再需要先取整再传给AOI
+// Z轴用于飞行、多层地图，2D场景下保持为0即可
+type Position struct {
+	X float32
+	Y float32
+	Z float32
+}
+
+type EventType int
+
+const (
+	_          EventType = iota
+	EventEnter           // Target进入了Watcher的视野
+	EventLeave           // Target离开了Watcher的视野
+	EventMove            // Watcher视野内的Target移动了
+	EventSync            // Watcher进入场景或移动后，同步其视野内已有的Target
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventEnter:
+		return "enter"
+	case EventLeave:
+		return "leave"
+	case EventMove:
+		return "move"
+	case EventSync:
+		return "sync"
+	}
+	return "unknown"
+}
+
+type Event struct {
+	Type      EventType
+	WatcherId int64    // 接收事件的Entity
+	TargetId  int64    // 事件的主体
+	Position  Position // Target当前所在的位置
+}
+
+// Listener 由使用方的Entity实现，用于接收AOI事件
+type Listener interface {
+	OnEvent(ev Event)
+}
+
+// ListenerFunc 方便直接用函数作为Listener
+type ListenerFunc func(ev Event)
+
+func (f ListenerFunc) OnEvent(ev Event) {
+	f(ev)
+}
@@ -1,66 +1,222 @@
 package infinitySight
 
 import (
-	"fmt"
 	"sync"
+	"sync/atomic"
+
+	"game-toolkit/aoi"
 )
 
 /*
 	[思路]
-	无限视野的方案实现最简单，适用于场景内Entity比较少的情况
-	所有Entity的可观测行为均需要广播给在场景内的其他Entity
+	无限视野的方案实现最简单，适用于场景内Entity比较少的情况，比如大厅、小型竞技场
+	所有Entity的可观测行为均需要广播给在场景内的其他Entity，新进入的Entity也会收到场景内已有Entity的sync
+	每个场景一把锁，事件在持锁期间暂存，释放锁之后再投递，Listener里可以放心地再调用场景的方法
+	Manager是兼容旧代码的默认场景，没有通过Scene.NewEntity创建的Entity都进入Manager
 */
 
-var Manager manager
+var Manager = NewScene()
+
+var EntityIdGen int64
 
-type manager struct {
+type Scene struct {
 	sync.Mutex
-	EntityMap map[int64]*Entity
+	EntityMap  map[int64]*Entity // 当前在场景内的Entity
+	dispatcher aoi.Dispatcher    // 当前这次调用产生的事件，释放锁之后再投递
 }
 
-type Entity struct {
-	Id        int64
-	PositionX int
-	PositionY int
-}
+var _ aoi.Scene = (*Scene)(nil)
 
-func init() {
-	Manager = manager{
+func NewScene() *Scene {
+	return &Scene{
 		EntityMap: make(map[int64]*Entity),
 	}
 }
 
-func (e *Entity) EnterMap() {
-	Manager.Lock()
-	defer Manager.Unlock()
-	for _, entity := range Manager.EntityMap {
-		entity.ReceiveNews(e.Id, "enterMap")
+// NewEntity 创建一个归属于当前场景的Entity，和其他实现一样由EntityIdGen自动生成id
+func (s *Scene) NewEntity() *Entity {
+	return &Entity{Id: atomic.AddInt64(&EntityIdGen, 1), scene: s}
+}
+
+// Close 销毁场景，清空Entity，不再发送任何消息
+func (s *Scene) Close() {
+	s.Lock()
+	defer s.Unlock()
+	for _, e := range s.EntityMap {
+		e.inMap = false
+	}
+	s.EntityMap = make(map[int64]*Entity)
+	s.dispatcher.Reset()
+}
+
+// Enter 实现aoi.Scene，新进入的Entity和场景内已有的Entity互相可见
+func (s *Scene) Enter(id int64, pos aoi.Position, listener aoi.Listener) error {
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	if err := s.enter(&Entity{Id: id, Listener: listener, scene: s}, pos); err != nil {
+		return err
 	}
-	Manager.EntityMap[e.Id] = e
+	// 之后NewEntity生成的id不能和它重复
+	aoi.ReserveId(&EntityIdGen, id)
+	return nil
 }
 
-func (e *Entity) LeaveMap() {
-	Manager.Lock()
-	defer Manager.Unlock()
-	delete(Manager.EntityMap, e.Id)
-	for _, entity := range Manager.EntityMap {
-		entity.ReceiveNews(e.Id, "leaveMap")
+func (s *Scene) Leave(id int64) error {
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	e, ok := s.EntityMap[id]
+	if !ok {
+		return aoi.ErrEntityNotFound
+	}
+	s.leave(e)
+	return nil
+}
+
+func (s *Scene) Move(id int64, pos aoi.Position) error {
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	e, ok := s.EntityMap[id]
+	if !ok {
+		return aoi.ErrEntityNotFound
 	}
+	s.move(e, pos)
+	return nil
 }
 
-func (e *Entity) ChangePosition(x, y int) {
-	Manager.Lock()
-	defer Manager.Unlock()
+// Visible 场景内的其他Entity均可见
+func (s *Scene) Visible(id int64) (result []int64) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.EntityMap[id]; !ok {
+		return
+	}
+	for otherId := range s.EntityMap {
+		if otherId != id {
+			result = append(result, otherId)
+		}
+	}
+	return
+}
+
+// EntityCount 当前场景内的Entity数量
+func (s *Scene) EntityCount() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.EntityMap)
+}
+
+// 以下方法均需要持锁调用
+
+func (s *Scene) emit(watcher *Entity, category aoi.EventType, target *Entity) {
+	s.dispatcher.Add(watcher.Listener, aoi.Event{
+		Type:      category,
+		WatcherId: watcher.Id,
+		TargetId:  target.Id,
+		Position:  target.position(),
+	})
+}
+
+func (s *Scene) enter(e *Entity, pos aoi.Position) error {
+	if _, ok := s.EntityMap[e.Id]; ok || e.inMap {
+		return aoi.ErrEntityExists
+	}
+	e.PositionX, e.PositionY, e.PositionZ = pos.X, pos.Y, pos.Z
+	for _, entity := range s.EntityMap {
+		s.emit(entity, aoi.EventEnter, e)
+		s.emit(e, aoi.EventSync, entity)
+	}
+	s.EntityMap[e.Id] = e
+	e.inMap = true
+	return nil
+}
 
-	e.PositionX, e.PositionY = x, y
-	for id, entity := range Manager.EntityMap {
+func (s *Scene) leave(e *Entity) {
+	delete(s.EntityMap, e.Id)
+	e.inMap = false
+	for _, entity := range s.EntityMap {
+		s.emit(entity, aoi.EventLeave, e)
+	}
+}
+
+func (s *Scene) move(e *Entity, pos aoi.Position) {
+	e.PositionX, e.PositionY, e.PositionZ = pos.X, pos.Y, pos.Z
+	for id, entity := range s.EntityMap {
 		if id == e.Id {
 			continue
 		}
-		entity.ReceiveNews(e.Id, fmt.Sprintf("change position to: x %d, y %d", x, y))
+		s.emit(entity, aoi.EventMove, e)
+	}
+}
+
+type Entity struct {
+	Id        int64
+	PositionX float32
+	PositionY float32
+	PositionZ float32
+
+	Listener aoi.Listener // 接收AOI事件，为nil时丢弃事件
+
+	scene *Scene // 为nil时使用Manager
+	inMap bool
+}
+
+// Scene 获取Entity所属的场景
+func (e *Entity) Scene() *Scene {
+	if e.scene == nil {
+		return Manager
+	}
+	return e.scene
+}
+
+// Position 并发安全地获取当前位置
+func (e *Entity) Position() aoi.Position {
+	s := e.Scene()
+	s.Lock()
+	defer s.Unlock()
+	return e.position()
+}
+
+func (e *Entity) position() aoi.Position {
+	return aoi.Position{X: e.PositionX, Y: e.PositionY, Z: e.PositionZ}
+}
+
+// EnterMap 以当前的坐标进入场景，进入后会收到场景内已有Entity的sync
+func (e *Entity) EnterMap() error {
+	s := e.Scene()
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	return s.enter(e, e.position())
+}
+
+func (e *Entity) LeaveMap() {
+	s := e.Scene()
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	if !e.inMap {
+		return
+	}
+	s.leave(e)
+}
+
+// ChangePosition 在当前高度上平移
+func (e *Entity) ChangePosition(x, y float32) error {
+	s := e.Scene()
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	if !e.inMap {
+		return aoi.ErrEntityNotFound
 	}
+	s.move(e, aoi.Position{X: x, Y: y, Z: e.PositionZ})
+	return nil
 }
 
-func (e *Entity) ReceiveNews(entityId int64, data any) {
-	fmt.Printf("%d received %d's message, data is %+v\n", e.Id, entityId, data)
+func (e *Entity) ChangePosition3D(x, y, z float32) error {
+	s := e.Scene()
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	if !e.inMap {
+		return aoi.ErrEntityNotFound
+	}
+	s.move(e, aoi.Position{X: x, Y: y, Z: z})
+	return nil
 }
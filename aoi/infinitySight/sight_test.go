@@ -1,22 +1,153 @@
 package infinitySight
 
 import (
+	"sync"
+	"sync/atomic"
 	"testing"
+
+	"game-toolkit/aoi"
+	"game-toolkit/aoi/aoitest"
 )
 
 func TestEntity(t *testing.T) {
-	e1 := Entity{Id: 1}
+	var events []aoi.Event
+	listener := aoi.ListenerFunc(func(ev aoi.Event) {
+		events = append(events, ev)
+	})
+	e1 := Entity{Id: 1, Listener: listener}
 	e1.EnterMap()
 
-	e2 := Entity{Id: 2}
+	e2 := Entity{Id: 2, Listener: listener}
 	e2.EnterMap()
 
-	e3 := Entity{Id: 3}
+	e3 := Entity{Id: 3, Listener: listener}
 	e3.EnterMap()
 
+	events = nil
 	e1.ChangePosition(1, 2)
+	if len(events) != 2 {
+		t.Fatalf("expect 2 move events, got %d", len(events))
+	}
+	for _, ev := range events {
+		if ev.Type != aoi.EventMove || ev.TargetId != 1 || ev.Position != (aoi.Position{X: 1, Y: 2}) {
+			t.Fatalf("unexpected event %+v", ev)
+		}
+	}
 
 	e3.LeaveMap()
 	e2.LeaveMap()
 	e1.LeaveMap()
 }
+
+func TestJoinSync(t *testing.T) {
+	var events []aoi.Event
+	listener := aoi.ListenerFunc(func(ev aoi.Event) {
+		events = append(events, ev)
+	})
+	scene := NewScene()
+	a := scene.NewEntity()
+	a.PositionX, a.Listener = 5, listener
+	a.EnterMap()
+	b := scene.NewEntity()
+	b.Listener = listener
+	b.EnterMap()
+
+	// 新进入的Entity收到已有Entity的sync，已有的收到enter
+	if len(events) != 2 {
+		t.Fatalf("expect 2 events, got %+v", events)
+	}
+	for _, ev := range events {
+		switch ev.WatcherId {
+		case a.Id:
+			if ev.Type != aoi.EventEnter || ev.TargetId != b.Id {
+				t.Fatalf("unexpected event %+v", ev)
+			}
+		case b.Id:
+			if ev.Type != aoi.EventSync || ev.TargetId != a.Id || ev.Position != (aoi.Position{X: 5}) {
+				t.Fatalf("unexpected event %+v", ev)
+			}
+		}
+	}
+	if err := b.EnterMap(); err != aoi.ErrEntityExists {
+		t.Fatalf("enter twice: %v", err)
+	}
+	if err := scene.Enter(a.Id, aoi.Position{}, nil); err != aoi.ErrEntityExists {
+		t.Fatalf("enter with existing id: %v", err)
+	}
+	// 以指定id进入之后，NewEntity不会再生成这个id
+	id := atomic.LoadInt64(&EntityIdGen) + 1
+	scene.Enter(id, aoi.Position{}, nil)
+	if e := scene.NewEntity(); e.Id == id {
+		t.Fatalf("NewEntity reused id %d", id)
+	}
+}
+
+func TestSceneIsolation(t *testing.T) {
+	var events []aoi.Event
+	listener := aoi.ListenerFunc(func(ev aoi.Event) {
+		events = append(events, ev)
+	})
+	s1, s2 := NewScene(), NewScene()
+	a := s1.NewEntity()
+	a.Listener = listener
+	a.EnterMap()
+	s2.Enter(2, aoi.Position{}, listener)
+	if len(events) != 0 {
+		t.Fatalf("entities in different scenes should not see each other: %+v", events)
+	}
+	if a.Scene() != s1 || Manager.EntityCount() != 0 {
+		t.Fatalf("entity should enter its own scene instead of Manager")
+	}
+
+	s1.Close()
+	if s1.EntityCount() != 0 || s2.EntityCount() != 1 {
+		t.Fatalf("close s1 should not affect s2")
+	}
+	if err := a.ChangePosition(1, 1); err != aoi.ErrEntityNotFound {
+		t.Fatalf("move after close: %v", err)
+	}
+	// 关闭之后可以重新进入
+	if err := a.EnterMap(); err != nil {
+		t.Fatalf("enter after close: %v", err)
+	}
+}
+
+// Listener里反过来调用场景不会死锁，需要配合-race运行
+func TestReentrantListener(t *testing.T) {
+	scene := NewScene()
+	var listener aoi.ListenerFunc
+	listener = func(ev aoi.Event) {
+		scene.Visible(ev.WatcherId)
+		if ev.Type == aoi.EventEnter && ev.TargetId%5 == 0 {
+			_ = scene.Move(ev.TargetId, aoi.Position{X: ev.Position.X + 1})
+		}
+	}
+
+	var wg sync.WaitGroup
+	for w := int64(0); w < 4; w++ {
+		wg.Add(1)
+		go func(w int64) {
+			defer wg.Done()
+			for i := int64(1); i <= 50; i++ {
+				id := w*100 + i
+				_ = scene.Enter(id, aoi.Position{X: float32(i)}, listener)
+				_ = scene.Move(id, aoi.Position{Y: float32(i)})
+				if i%3 == 0 {
+					_ = scene.Leave(id)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if scene.EntityCount() != 4*(50-16) {
+		t.Fatalf("unexpected entity count %d", scene.EntityCount())
+	}
+}
+
+func TestConformance(t *testing.T) {
+	aoitest.RunConformance(t, func() aoi.Scene { return NewScene() }, aoitest.Options{Unbounded: true})
+}
+
+func TestCapped(t *testing.T) {
+	aoitest.RunCapped(t, func() aoi.Scene { return NewScene() })
+}
@@ -0,0 +1,51 @@
+package crosschain
+
+import "game-toolkit/aoi"
+
+/*
+	[思路]
+	遮挡只影响可见关系，不影响几何上的覆盖关系，遮挡物变化后对视野覆盖了它的Entity调用Refresh即可，
+	Refresh同时处理我看别人和别人看我两个方向。每个Entity的视野不同，只能逐个判断视野范围和遮挡物是否相交
+	有遮挡物时，在覆盖范围内移动也可能被墙挡住或者绕出墙角，移动时需要检查整个覆盖集合和观察者集合
+*/
+
+var _ aoi.OcclusionScene = (*Scene)(nil)
+
+func (s *Scene) AddOccluder(id int, seg aoi.Segment) {
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	s.occluders.Add(id, seg)
+}
+
+func (s *Scene) RemoveOccluder(id int) error {
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	return s.occluders.Remove(id)
+}
+
+func (s *Scene) SetOccluderEnabled(id int, enabled bool) error {
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	return s.occluders.SetEnabled(id, enabled)
+}
+
+// 重新计算视野范围(含防抖范围)和segs相交的Entity的可见关系
+func (m *nodeManager) refreshNear(segs ...aoi.Segment) {
+	var affected []*Entity
+	for _, e := range m.entityMap {
+		reach := e.SightX
+		if e.SightY > reach {
+			reach = e.SightY
+		}
+		reach += m.hysteresis
+		for _, seg := range segs {
+			if seg.Near(e.position(), reach) {
+				affected = append(affected, e)
+				break
+			}
+		}
+	}
+	for _, e := range affected {
+		m.Refresh(e)
+	}
+}
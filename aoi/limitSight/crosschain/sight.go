@@ -1,9 +1,11 @@
 package crosschain
 
 import (
-	"fmt"
-	"math"
+	"errors"
+	"sync"
 	"sync/atomic"
+
+	"game-toolkit/aoi"
 )
 
 const (
@@ -11,39 +13,256 @@ const (
 	NodeSentinelDown // 下界哨兵
 	NodeSentinelUp   // 上界哨兵
 	NodeEntity
+	NodeHead // 链表头节点，比任何节点都小
+	NodeTail // 链表尾节点，比任何节点都大
 
 	AxisX = 1
 	AxisY = 2
+	AxisZ = 3
 
 	InvalidSight = -1
 )
 
 /*
 	[思路]
-	在X轴和Y轴方向上各建立一个链表，故称之为十字链表
+	在X轴和Y轴方向上各建立一个链表，故称之为十字链表。飞行、多层地图在Z轴上再建立第三个链表，
+	三个轴上都被哨兵覆盖才算在视野内，2D场景的Z坐标都是0，Z轴链表上的节点不会移动
+	每个链表都有固定的头尾节点，插入、删除、交换节点时不需要特殊处理链表两端
 	以自身(比如小A)的视角来看，自己的左右哨兵覆盖范围内的所有Entity，都能被自己看到
 	以其他Entity的视角来看，其他Entity的左右哨兵覆盖范围内如果有小A，那么其他Entity可以看到小A
-	优势: 每个Entity都可以有自己的视野范围，视野设置更加灵活
+	移动时节点从当前位置向左或向右滑动，我的Entity节点越过别人的哨兵、或者我的哨兵越过别人的Entity节点时，
+	双方的可见关系才可能变化，所以只需要检查越过的节点，开销和移动距离内的节点数成正比
+	每个Entity记录几何上覆盖了它的观察者集合，随着越过哨兵增量更新，"谁能看到我"只需要直接查集合
+	几何上互相覆盖之后，还需要满足双方的aoi.Visibility掩码和场景配置的Filter，才算真正可见
+	防抖: 配置了Hysteresis之后，进入覆盖范围仍然以哨兵为准，已经覆盖的Entity要离开视野半宽+Hysteresis才算不再覆盖，
+	离开的判断不依赖哨兵，移动或者调整视野时顺带检查自己的覆盖集合和观察者集合，开销和集合大小成正比
+	和其他实现一样，一个Scene一把锁，持锁期间链表和各个集合只更新、不回调，事件暂存起来释放锁之后再投递，
+	所以Listener里可以再调用场景的方法(比如让另一个Entity移动)，不会看到改了一半的链表
+	优势: 每个Entity都可以有自己的视野范围，X轴和Y轴的视野半宽也可以不同，运行时还能随时调整，视野设置更加灵活
 	缺点: 对CPU的消耗较大
 */
 
 var EntityIdGen int64
 
-var NodeManager *nodeManager
+const defaultSight = 10
+
+var ErrInvalidSight = errors.New("crosschain: sight must be positive")
+
+type Config struct {
+	Sight  float32    // 通过aoi.Scene接口进入场景的Entity使用的视野距离，<=0时使用defaultSight
+	SightX float32    // X轴方向的视野半宽，<=0时使用Sight
+	SightY float32    // Y轴方向的视野半宽，<=0时使用Sight
+	SightZ float32    // Z轴方向的视野半宽，<=0时使用Sight
+	Batch  bool       // 是否开启批量模式，开启后事件缓存到帧末由Flush合并投递
+	Filter aoi.Filter // 额外的可见性判断，为nil时不过滤
+
+	Hysteresis float32 // 防抖距离，已经覆盖的Entity要离开视野半宽+Hysteresis才会离开视野，<=0时不防抖
+}
+
+// Scene 每个场景各自持有一套十字链表
+type Scene struct {
+	sync.Mutex
+	nodeManager
+	config     Config
+	buffer     *aoi.EventBuffer
+	dispatcher aoi.Dispatcher // 当前这次调用产生的事件，释放锁之后再投递
+	silent     bool           // 静默恢复快照时不发送任何事件
+}
+
+var (
+	_ aoi.Scene           = (*Scene)(nil)
+	_ aoi.Flusher         = (*Scene)(nil)
+	_ aoi.VisibilityScene = (*Scene)(nil)
+)
+
+func NewScene(config Config) *Scene {
+	if config.Sight <= 0 {
+		config.Sight = defaultSight
+	}
+	if config.SightX <= 0 {
+		config.SightX = config.Sight
+	}
+	if config.SightY <= 0 {
+		config.SightY = config.Sight
+	}
+	if config.SightZ <= 0 {
+		config.SightZ = config.Sight
+	}
+	s := &Scene{
+		nodeManager: newNodeManager(config.Filter),
+		config:      config,
+	}
+	if config.Hysteresis > 0 {
+		s.hysteresis = config.Hysteresis
+	}
+	s.occluders = aoi.NewSceneOccluders(config.Sight, s.refreshNear)
+	if config.Batch {
+		s.buffer = aoi.NewEventBuffer()
+	}
+	return s
+}
+
+// Flush 批量模式下把本帧缓存的事件合并后投递给各个Watcher
+func (s *Scene) Flush() {
+	if s.buffer == nil {
+		return
+	}
+	aoi.FlushBuffer(s, s.buffer, func(watcherId int64) aoi.Listener {
+		if e, ok := s.entityMap[watcherId]; ok {
+			return e.Listener
+		}
+		return nil
+	})
+}
+
+// NewEntity 创建一个归属于当前场景的Entity
+func (s *Scene) NewEntity() (e *Entity) {
+	return &Entity{Id: atomic.AddInt64(&EntityIdGen, 1), SightX: InvalidSight, SightY: InvalidSight, SightZ: InvalidSight, scene: s, visibility: aoi.DefaultVisibility}
+}
+
+// Enter 实现aoi.Scene，以指定id和场景默认视野进入场景
+func (s *Scene) Enter(id int64, pos aoi.Position, listener aoi.Listener) error {
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	if _, ok := s.entityMap[id]; ok {
+		return aoi.ErrEntityExists
+	}
+	e := &Entity{Id: id, SightX: InvalidSight, SightY: InvalidSight, SightZ: InvalidSight, Listener: listener, scene: s, visibility: aoi.DefaultVisibility}
+	if err := e.enterMap3D(s.config.SightX, s.config.SightY, s.config.SightZ, pos.X, pos.Y, pos.Z); err != nil {
+		return err
+	}
+	// 之后NewEntity生成的id不能和它重复
+	aoi.ReserveId(&EntityIdGen, id)
+	return nil
+}
+
+func (s *Scene) Leave(id int64) error {
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	e, ok := s.entityMap[id]
+	if !ok {
+		return aoi.ErrEntityNotFound
+	}
+	e.leaveMap()
+	return nil
+}
+
+func (s *Scene) Move(id int64, pos aoi.Position) error {
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	e, ok := s.entityMap[id]
+	if !ok {
+		return aoi.ErrEntityNotFound
+	}
+	s.ChangePosition(e, pos.X, pos.Y, pos.Z)
+	return nil
+}
+
+// SetSight 修改id的视野范围，只移动它的哨兵
+func (s *Scene) SetSight(id int64, sightX, sightY float32) error {
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	e, ok := s.entityMap[id]
+	if !ok {
+		return aoi.ErrEntityNotFound
+	}
+	return e.setSight3D(sightX, sightY, e.SightZ)
+}
+
+// SetSight3D 修改id三个轴上的视野范围
+func (s *Scene) SetSight3D(id int64, sightX, sightY, sightZ float32) error {
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	e, ok := s.entityMap[id]
+	if !ok {
+		return aoi.ErrEntityNotFound
+	}
+	return e.setSight3D(sightX, sightY, sightZ)
+}
+
+func (s *Scene) SetVisibility(id int64, v aoi.Visibility) error {
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	e, ok := s.entityMap[id]
+	if !ok {
+		return aoi.ErrEntityNotFound
+	}
+	s.nodeManager.SetVisibility(e, v)
+	return nil
+}
+
+func (s *Scene) Refresh(id int64) error {
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	e, ok := s.entityMap[id]
+	if !ok {
+		return aoi.ErrEntityNotFound
+	}
+	s.nodeManager.Refresh(e)
+	return nil
+}
+
+func (s *Scene) Visible(id int64) (result []int64) {
+	s.Lock()
+	defer s.Unlock()
+	e, ok := s.entityMap[id]
+	if !ok {
+		return
+	}
+	for targetId := range e.watching {
+		result = append(result, targetId)
+	}
+	return
+}
+
+func (s *Scene) GetEntity(id int64) *Entity {
+	s.Lock()
+	defer s.Unlock()
+	return s.entityMap[id]
+}
+
+// GetSelfSightEntities 获取id能看到的Entity列表
+func (s *Scene) GetSelfSightEntities(id int64) []*Entity {
+	s.Lock()
+	defer s.Unlock()
+	return s.nodeManager.GetSelfSightEntities(id)
+}
+
+// GetOtherSightEntities 获取能看到id的Entity列表
+func (s *Scene) GetOtherSightEntities(id int64) []*Entity {
+	s.Lock()
+	defer s.Unlock()
+	return s.nodeManager.GetOtherSightEntities(id)
+}
 
 type nodeManager struct {
 	XNodeHead *Node
 	YNodeHead *Node
+	ZNodeHead *Node
+	xNodeTail *Node
+	yNodeTail *Node
+	zNodeTail *Node
+
+	entityMap  map[int64]*Entity
+	filter     aoi.Filter
+	hysteresis float32            // 防抖距离，见Config.Hysteresis
+	occluders  aoi.SceneOccluders // 遮挡物
+}
 
-	entityMap map[int64]*Entity
+func newNodeManager(filter aoi.Filter) nodeManager {
+	m := nodeManager{entityMap: make(map[int64]*Entity), filter: filter}
+	m.XNodeHead, m.xNodeTail = newList()
+	m.YNodeHead, m.yNodeTail = newList()
+	m.ZNodeHead, m.zNodeTail = newList()
+	return m
 }
 
-func init() {
-	NodeManager = &nodeManager{
-		XNodeHead: nil,
-		YNodeHead: nil,
-		entityMap: make(map[int64]*Entity),
-	}
+func newList() (head, tail *Node) {
+	head = &Node{Category: NodeHead}
+	tail = &Node{Category: NodeTail}
+	head.Next = tail
+	tail.Front = head
+	return
 }
 
 func (m *nodeManager) AddEntity(e *Entity) {
@@ -57,15 +276,50 @@ func (m *nodeManager) AddEntity(e *Entity) {
 	m.addNode(e.YNode[0], AxisY)
 	m.addNode(e.YNode[1], AxisY)
 	m.addNode(e.YNode[2], AxisY)
+	m.addNode(e.ZNode[0], AxisZ)
+	m.addNode(e.ZNode[1], AxisZ)
+	m.addNode(e.ZNode[2], AxisZ)
 	m.entityMap[e.Id] = e
+	e.inRange = make(map[int64]struct{})
+	e.observers = make(map[int64]struct{})
+	e.watching = make(map[int64]struct{})
+	e.watchedBy = make(map[int64]struct{})
+
+	// 我的视野范围内有谁
+	for n := e.XNode[0]; n != e.XNode[2]; n = n.Next {
+		if n.Category != NodeEntity || n.ID == e.Id {
+			continue
+		}
+		if target := m.entityMap[n.ID]; m.inSight(e, target) {
+			m.cover(e, target)
+		}
+	}
+	// 谁的视野范围覆盖了我: 从头遍历到我的X节点，左哨兵已经出现、右哨兵还没出现的Entity在X轴上覆盖了我
+	open := make(map[int64]struct{})
+	for n := m.XNodeHead; n != e.XNode[1]; n = n.Next {
+		if n.ID == e.Id {
+			continue
+		}
+		switch n.Category {
+		case NodeSentinelDown:
+			open[n.ID] = struct{}{}
+		case NodeSentinelUp:
+			delete(open, n.ID)
+		}
+	}
+	for id := range open {
+		if watcher := m.entityMap[id]; m.inSight(watcher, e) {
+			m.cover(watcher, e)
+		}
+	}
 
 	// 我能看到谁
-	for _, entity := range m.GetSelfSightEntities(e.Id) {
-		e.SendMessage(fmt.Sprintf("I Enter Map, I can see %d", entity.Id))
+	for id := range e.inRange {
+		m.updateSight(e, m.entityMap[id], aoi.EventSync)
 	}
 	// 谁能看到我
-	for _, entity := range m.GetOtherSightEntities(e.Id) {
-		entity.SendMessage(fmt.Sprintf("I can see %d enter map right now", e.Id))
+	for id := range e.observers {
+		m.updateSight(m.entityMap[id], e, aoi.EventEnter)
 	}
 }
 
@@ -75,12 +329,22 @@ func (m *nodeManager) RemoveEntity(e *Entity) {
 	}
 
 	// 我能看到谁
-	for _, entity := range m.GetSelfSightEntities(e.Id) {
-		e.SendMessage(fmt.Sprintf("I Leave Map, so I can see %d any more", entity.Id))
+	for id := range e.watching {
+		entity := m.entityMap[id]
+		m.unwatch(e, entity)
+		e.sendEvent(aoi.EventLeave, entity)
 	}
 	// 谁能看到我
-	for _, entity := range m.GetOtherSightEntities(e.Id) {
-		entity.SendMessage(fmt.Sprintf("I can see %d leave map right now", e.Id))
+	for id := range e.watchedBy {
+		entity := m.entityMap[id]
+		m.unwatch(entity, e)
+		entity.sendEvent(aoi.EventLeave, e)
+	}
+	for id := range e.inRange {
+		m.uncover(e, m.entityMap[id])
+	}
+	for id := range e.observers {
+		m.uncover(m.entityMap[id], e)
 	}
 
 	m.RemoveNode(e.XNode[0], AxisX)
@@ -89,70 +353,182 @@ func (m *nodeManager) RemoveEntity(e *Entity) {
 	m.RemoveNode(e.YNode[0], AxisY)
 	m.RemoveNode(e.YNode[1], AxisY)
 	m.RemoveNode(e.YNode[2], AxisY)
+	m.RemoveNode(e.ZNode[0], AxisZ)
+	m.RemoveNode(e.ZNode[1], AxisZ)
+	m.RemoveNode(e.ZNode[2], AxisZ)
 	delete(m.entityMap, e.Id)
 }
 
-func (m *nodeManager) ChangePosition(e *Entity, x, y int) {
-	// 我能看到谁
-	selfSights := make(map[int64]struct{})
-	otherSights := make(map[int64]struct{})
-	for _, entity := range m.GetSelfSightEntities(e.Id) {
-		selfSights[entity.Id] = struct{}{}
+func (m *nodeManager) ChangePosition(e *Entity, x, y, z float32) {
+	// 移动过程中越过的节点对应的Entity，只有它们和我的覆盖关系可能发生变化
+	selfCandidates := make(map[int64]struct{})  // 我可能开始或者不再覆盖的
+	otherCandidates := make(map[int64]struct{}) // 可能开始或者不再覆盖我的
+	cross := func(mine, other *Node) {
+		if other.ID == e.Id {
+			return
+		}
+		switch {
+		case mine.Category == NodeEntity && other.Category != NodeEntity:
+			// 我越过了别人的哨兵
+			otherCandidates[other.ID] = struct{}{}
+		case mine.Category != NodeEntity && other.Category == NodeEntity:
+			// 我的哨兵越过了别人
+			selfCandidates[other.ID] = struct{}{}
+		}
 	}
-	// 谁能看到我
-	for _, entity := range m.GetOtherSightEntities(e.Id) {
-		otherSights[entity.Id] = struct{}{}
+	m.shiftNodes(e.XNode, AxisX, x, e.SightX, cross)
+	m.shiftNodes(e.YNode, AxisY, y, e.SightY, cross)
+	m.shiftNodes(e.ZNode, AxisZ, z, e.SightZ, cross)
+	if m.hysteresis > 0 || !m.occluders.Empty() {
+		// 已经覆盖的离开哨兵时不会取消覆盖，需要检查是否离开了防抖范围；有遮挡物时视线可能被挡住
+		for id := range e.inRange {
+			selfCandidates[id] = struct{}{}
+		}
+		for id := range e.observers {
+			otherCandidates[id] = struct{}{}
+		}
 	}
 
-	//todo: 先暂且这么写，把整体思路先实现，代码后续考虑优化
-	xDiff := x - e.XNode[1].Value
-	yDiff := y - e.YNode[1].Value
-	m.RemoveNode(e.XNode[0], AxisX)
-	m.RemoveNode(e.XNode[1], AxisX)
-	m.RemoveNode(e.XNode[2], AxisX)
-	m.RemoveNode(e.YNode[0], AxisY)
-	m.RemoveNode(e.YNode[1], AxisY)
-	m.RemoveNode(e.YNode[2], AxisY)
-	e.XNode[0].Value += xDiff
-	e.XNode[1].Value += xDiff
-	e.XNode[2].Value += xDiff
-	e.YNode[0].Value += yDiff
-	e.YNode[1].Value += yDiff
-	e.YNode[2].Value += yDiff
-	m.addNode(e.XNode[0], AxisX)
-	m.addNode(e.XNode[1], AxisX)
-	m.addNode(e.XNode[2], AxisX)
-	m.addNode(e.YNode[0], AxisY)
-	m.addNode(e.YNode[1], AxisY)
-	m.addNode(e.YNode[2], AxisY)
-
-	for _, entity := range m.GetSelfSightEntities(e.Id) {
-		if _, ok := selfSights[entity.Id]; !ok {
-			// 我新看到了谁
-			e.SendMessage(fmt.Sprintf("I change position, I can see new friend %d", entity.Id))
-		} else {
-			delete(selfSights, entity.Id)
+	for id := range selfCandidates {
+		target := m.entityMap[id]
+		m.updateCover(e, target)
+		m.updateSight(e, target, aoi.EventSync)
+	}
+	for id := range otherCandidates {
+		watcher := m.entityMap[id]
+		m.updateCover(watcher, e)
+		// 新看到我的已经收到了enter，不用再发move
+		if !m.updateSight(watcher, e, aoi.EventEnter) {
+			delete(otherCandidates, id)
 		}
 	}
-	// 谁从我的视野里消失了
-	for id := range selfSights {
-		sightOut := m.entityMap[id]
-		e.SendMessage(fmt.Sprintf("I change position, I cannot see %d", sightOut.Id))
+	// 一直能看到我的，同步我的新位置
+	for id := range e.watchedBy {
+		if _, ok := otherCandidates[id]; ok {
+			continue
+		}
+		m.entityMap[id].sendEvent(aoi.EventMove, e)
 	}
+}
 
-	for _, entity := range m.GetOtherSightEntities(e.Id) {
-		if _, ok := otherSights[entity.Id]; !ok {
-			// 谁从现在开始看到了我
-			entity.SendMessage(fmt.Sprintf("I can see a new friend %d", e.Id))
-		} else {
-			delete(otherSights, entity.Id)
+// 把一个Entity在某个轴上的三个节点整体平移到value，先移动前进方向最前面的节点，避免自己的节点互相越过
+// 哨兵的值每次都按value-sight、value+sight重新计算，而不是累加位移，避免浮点误差累积之后哨兵和视野半宽对不上
+func (m *nodeManager) shiftNodes(nodes [3]*Node, category int, value, sight float32, cross func(mine, other *Node)) {
+	values := [3]float32{value - sight, value, value + sight}
+	switch {
+	case value > nodes[1].Value:
+		for i := 2; i >= 0; i-- {
+			m.changeNode(nodes[i], category, values[i], cross)
+		}
+	case value < nodes[1].Value:
+		for i := 0; i <= 2; i++ {
+			m.changeNode(nodes[i], category, values[i], cross)
+		}
+	}
+}
+
+// ChangeSight 修改视野范围，自身节点不动，左右(上下)哨兵各自滑动到新的位置，
+// 只有哨兵越过的Entity可能进出我的视野，别人能否看到我不受影响
+func (m *nodeManager) ChangeSight(e *Entity, sightX, sightY, sightZ float32) {
+	candidates := make(map[int64]struct{})
+	cross := func(mine, other *Node) {
+		if other.Category == NodeEntity && other.ID != e.Id {
+			candidates[other.ID] = struct{}{}
 		}
 	}
-	// 我从谁的视野里消失了
-	for id := range otherSights {
-		sightOut := m.entityMap[id]
-		sightOut.SendMessage(fmt.Sprintf("I cannot see %d", e.Id))
+	m.changeNode(e.XNode[0], AxisX, e.XNode[1].Value-sightX, cross)
+	m.changeNode(e.XNode[2], AxisX, e.XNode[1].Value+sightX, cross)
+	m.changeNode(e.YNode[0], AxisY, e.YNode[1].Value-sightY, cross)
+	m.changeNode(e.YNode[2], AxisY, e.YNode[1].Value+sightY, cross)
+	m.changeNode(e.ZNode[0], AxisZ, e.ZNode[1].Value-sightZ, cross)
+	m.changeNode(e.ZNode[2], AxisZ, e.ZNode[1].Value+sightZ, cross)
+	e.SightX, e.SightY, e.SightZ = sightX, sightY, sightZ
+	if m.hysteresis > 0 {
+		// 视野缩小时，防抖范围内的Entity哨兵不会再越过，需要单独检查
+		for id := range e.inRange {
+			candidates[id] = struct{}{}
+		}
 	}
+
+	for id := range candidates {
+		target := m.entityMap[id]
+		m.updateCover(e, target)
+		m.updateSight(e, target, aoi.EventSync)
+	}
+}
+
+// SetVisibility 修改可见性掩码，并按新的掩码发送进出视野的事件
+func (m *nodeManager) SetVisibility(e *Entity, v aoi.Visibility) {
+	e.visibility = v
+	m.Refresh(e)
+}
+
+// Refresh Filter依赖的外部状态变化后，重新计算e相关的可见关系
+// 几何上的覆盖关系没有变，只需要重新判断覆盖集合里的Entity
+func (m *nodeManager) Refresh(e *Entity) {
+	for id := range e.inRange {
+		m.updateSight(e, m.entityMap[id], aoi.EventSync)
+	}
+	for id := range e.observers {
+		m.updateSight(m.entityMap[id], e, aoi.EventEnter)
+	}
+}
+
+// 根据几何上的覆盖关系和可见性，重新判断watcher能否看到target，发送对应的事件，返回值表示可见关系是否发生了变化
+// enterType是新看到时发送的事件，场景里发生变化的一方收到sync，其他人收到enter
+func (m *nodeManager) updateSight(watcher, target *Entity, enterType aoi.EventType) bool {
+	_, covered := watcher.inRange[target.Id]
+	_, before := watcher.watching[target.Id]
+	after := covered && m.canSee(watcher, target)
+	switch {
+	case !before && after:
+		m.watch(watcher, target)
+		watcher.sendEvent(enterType, target)
+	case before && !after:
+		m.unwatch(watcher, target)
+		watcher.sendEvent(aoi.EventLeave, target)
+	default:
+		return false
+	}
+	return true
+}
+
+func (m *nodeManager) updateCover(watcher, target *Entity) {
+	_, covered := watcher.inRange[target.Id]
+	if m.inSight(watcher, target) || covered && m.inLeaveRange(watcher, target) {
+		m.cover(watcher, target)
+	} else {
+		m.uncover(watcher, target)
+	}
+}
+
+// 几何上watcher的视野范围覆盖了target
+func (m *nodeManager) cover(watcher, target *Entity) {
+	watcher.inRange[target.Id] = struct{}{}
+	target.observers[watcher.Id] = struct{}{}
+}
+
+func (m *nodeManager) uncover(watcher, target *Entity) {
+	delete(watcher.inRange, target.Id)
+	delete(target.observers, watcher.Id)
+}
+
+func (m *nodeManager) watch(watcher, target *Entity) {
+	watcher.watching[target.Id] = struct{}{}
+	target.watchedBy[watcher.Id] = struct{}{}
+}
+
+func (m *nodeManager) unwatch(watcher, target *Entity) {
+	delete(watcher.watching, target.Id)
+	delete(target.watchedBy, watcher.Id)
+}
+
+// watcher能否看到target，几何上的判断由调用方负责
+func (m *nodeManager) canSee(watcher, target *Entity) bool {
+	if !watcher.visibility.CanSee(target.visibility) || m.occluders.Blocked(watcher.position(), target.position()) {
+		return false
+	}
+	return m.filter == nil || m.filter(watcher.Id, target.Id)
 }
 
 // GetSelfSightEntities 获取自己能看到的Entity列表
@@ -161,136 +537,135 @@ func (m *nodeManager) GetSelfSightEntities(id int64) (result []*Entity) {
 	if !ok {
 		return
 	}
-
-	xIds := make(map[int64]struct{})
-	for n := self.XNode[0]; n != self.XNode[2]; n = n.Next {
-		if n.Category != NodeEntity || n.ID == id {
-			continue
-		}
-		xIds[n.ID] = struct{}{}
-	}
-
-	for n := self.YNode[0]; n != self.YNode[2]; n = n.Next {
-		if n.Category != NodeEntity || n.ID == id {
-			continue
-		}
-		// X轴和Y轴均有交集，那么说明是要找的entity
-		if _, ok := xIds[n.ID]; ok {
-			result = append(result, m.entityMap[n.ID])
-		}
+	for targetId := range self.watching {
+		result = append(result, m.entityMap[targetId])
 	}
 	return
 }
 
-// 获取能看到自己的Entity列表
+// GetOtherSightEntities 获取能看到自己的Entity列表，直接取增量维护的观察者集合
 func (m *nodeManager) GetOtherSightEntities(id int64) (result []*Entity) {
 	self, ok := m.entityMap[id]
 	if !ok {
 		return
 	}
+	for watcherId := range self.watchedBy {
+		result = append(result, m.entityMap[watcherId])
+	}
+	return
+}
 
-	xIds := make(map[int64]struct{})
-	for n := m.XNodeHead; n != nil; n = n.Next {
-		if n.Category != NodeEntity || n.ID == id {
-			continue
-		}
-		other := m.entityMap[n.ID]
-		if int(math.Abs(float64(n.Value-self.XNode[1].Value))) < other.Sight {
-			xIds[n.ID] = struct{}{}
-		}
+// 从头节点开始找到第一个比target大的节点，插到它前面，尾节点比任何节点都大，所以一定能找到
+func (m *nodeManager) addNode(target *Node, category int) {
+	n := m.head(category).Next
+	for nodeLess(n, target) {
+		n = n.Next
 	}
+	target.Next = n
+	target.Front = n.Front
+	n.Front.Next = target
+	n.Front = target
+}
 
-	for n := m.YNodeHead; n != nil; n = n.Next {
-		if n.Category != NodeEntity || n.ID == id {
-			continue
-		}
-		other := m.entityMap[n.ID]
-		if int(math.Abs(float64(n.Value-self.YNode[1].Value))) >= other.Sight {
-			continue
-		}
-		// X轴和Y轴均有交集，那么说明是要找的entity
-		if _, ok := xIds[n.ID]; ok {
-			result = append(result, m.entityMap[n.ID])
-		}
+// 头尾节点永远不会被删除，所以target前后一定都有节点
+func (m *nodeManager) RemoveNode(target *Node, category int) {
+	target.Front.Next = target.Next
+	target.Next.Front = target.Front
+	target.Front = nil
+	target.Next = nil
+}
+
+func (m *nodeManager) head(category int) *Node {
+	switch category {
+	case AxisX:
+		return m.XNodeHead
+	case AxisY:
+		return m.YNodeHead
+	default:
+		return m.ZNodeHead
 	}
-	return
 }
 
-func (m *nodeManager) addNode(target *Node, category int) {
-	if category == AxisX && m.XNodeHead == nil {
-		m.XNodeHead = target
-		return
+// changeNode 把target的值修改为value，从当前位置开始向左或向右滑动到新的位置，每越过一个节点调用一次cross
+// 开销只和越过的节点数有关，和场景里的Entity总数无关
+func (m *nodeManager) changeNode(target *Node, category int, value float32, cross func(mine, other *Node)) {
+	target.Value = value
+	for nodeLess(target.Next, target) {
+		next := target.Next
+		m.swapNode(target, next, category)
+		cross(target, next)
 	}
-	if category == AxisY && m.YNodeHead == nil {
-		m.YNodeHead = target
-		return
+	for nodeLess(target, target.Front) {
+		front := target.Front
+		m.swapNode(front, target, category)
+		cross(target, front)
 	}
+}
 
-	var header *Node
-	if category == AxisX {
-		header = m.XNodeHead
-	} else {
-		header = m.YNodeHead
-	}
-	for n := header; n != nil; n = n.Next {
-		// 找到了要插入的node，target应该放到n的前面
-		if target.Value < n.Value {
-			target.Next = n
-			if n.Front != nil {
-				target.Front = n.Front
-				n.Front.Next = target
-				n.Front = target
-			}
-			return
-		}
+// 交换两个相邻的节点，要求front.Next == next，头尾节点不会参与交换
+func (m *nodeManager) swapNode(front, next *Node, category int) {
+	prev, after := front.Front, next.Next
+	prev.Next = next
+	after.Front = front
+	next.Front, next.Next = prev, front
+	front.Front, front.Next = next, after
+}
 
-		// 说明value是最大的，此时替换即可
-		if n.Next == nil {
-			n.Next = target
-			target.Front = n
-			return
-		}
-	}
+// watcher的视野范围是否覆盖了target，视野边界上的不算
+func (m *nodeManager) inSight(watcher, target *Entity) bool {
+	return nodeLess(watcher.XNode[0], target.XNode[1]) && nodeLess(target.XNode[1], watcher.XNode[2]) &&
+		nodeLess(watcher.YNode[0], target.YNode[1]) && nodeLess(target.YNode[1], watcher.YNode[2]) &&
+		nodeLess(watcher.ZNode[0], target.ZNode[1]) && nodeLess(target.ZNode[1], watcher.ZNode[2])
 }
 
-func (m *nodeManager) RemoveNode(target *Node, category int) {
-	// 如果节点是头节点，则需要特殊处理
-	if category == AxisX {
-		if m.XNodeHead == target {
-			if m.XNodeHead.Next == nil {
-				m.XNodeHead = nil
-			} else {
-				m.XNodeHead = target.Next
-			}
-		}
-	} else {
-		if m.YNodeHead == target {
-			if m.YNodeHead.Next == nil {
-				m.YNodeHead = nil
-			} else {
-				m.YNodeHead = target.Next
-			}
-		}
+// 开启防抖时，已经覆盖的target还在这个范围内就继续覆盖，即每个轴上 |对方-我| < 视野半宽+Hysteresis
+func (m *nodeManager) inLeaveRange(watcher, target *Entity) bool {
+	if m.hysteresis <= 0 {
+		return m.inSight(watcher, target)
 	}
+	return within(target.XNode[1].Value, watcher.XNode[1].Value, watcher.SightX+m.hysteresis) &&
+		within(target.YNode[1].Value, watcher.YNode[1].Value, watcher.SightY+m.hysteresis) &&
+		within(target.ZNode[1].Value, watcher.ZNode[1].Value, watcher.SightZ+m.hysteresis)
+}
 
-	if target.Front != nil {
-		target.Front.Next = target.Next
+func within(v, center, sight float32) bool {
+	return v > center-sight && v < center+sight
+}
+
+// nodeLess 链表中节点的顺序，头节点最小、尾节点最大，值相同时按 上界哨兵 < Entity < 下界哨兵 排列，
+// 这样刚好在视野边界上的Entity落在哨兵之外，即 x-SightX < 对方 < x+SightX，
+// 两边的哨兵值都是float32按同样的方式算出来的，所以不同平台上的比较结果是确定的
+func nodeLess(a, b *Node) bool {
+	if a.Category == NodeHead || b.Category == NodeTail {
+		return a != b
 	}
-	if target.Next != nil {
-		target.Next.Front = target.Front
+	if a.Category == NodeTail || b.Category == NodeHead {
+		return false
 	}
-	target.Front = nil
-	target.Next = nil
+	if a.Value != b.Value {
+		return a.Value < b.Value
+	}
+	if ra, rb := categoryRank(a.Category), categoryRank(b.Category); ra != rb {
+		return ra < rb
+	}
+	return a.ID < b.ID
 }
 
-func (m *nodeManager) changeNode(target *Node, category int, value int) {
-	// todo: finish this
+func categoryRank(category int) int {
+	switch category {
+	case NodeSentinelUp:
+		return 0
+	case NodeEntity:
+		return 1
+	default:
+		return 2
+	}
 }
 
 type Node struct {
 	ID       int64 // entityId
 	Category int
-	Value    int
+	Value    float32
 	Front    *Node
 	Next     *Node
 }
@@ -298,43 +673,157 @@ type Node struct {
 type Entity struct {
 	Id int64
 
-	Sight int      // 视野距离
-	XNode [3]*Node // 0:左哨兵 1:自身 2:右哨兵
-	YNode [3]*Node // 0:下哨兵 1:自身 2:上哨兵
+	SightX float32  // X轴方向的视野半宽
+	SightY float32  // Y轴方向的视野半宽
+	SightZ float32  // Z轴方向的视野半宽
+	XNode  [3]*Node // 0:左哨兵 1:自身 2:右哨兵
+	YNode  [3]*Node // 0:下哨兵 1:自身 2:上哨兵
+	ZNode  [3]*Node // 0:下哨兵 1:自身 2:上哨兵
+
+	Listener aoi.Listener // 接收AOI事件，为nil时丢弃事件
+
+	scene      *Scene
+	visibility aoi.Visibility
+	inRange    map[int64]struct{} // 几何上在我视野范围内的Entity，不考虑可见性
+	observers  map[int64]struct{} // 几何上视野范围覆盖了我的Entity，不考虑可见性
+	watching   map[int64]struct{} // 我当前能看到的Entity，即已经给我发过enter的
+	watchedBy  map[int64]struct{} // 当前能看到我的Entity
 }
 
-func NewEntity() (e *Entity) {
-	return &Entity{Id: atomic.AddInt64(&EntityIdGen, 1), Sight: InvalidSight}
+// EnterMap 以正方形视野进入场景
+func (e *Entity) EnterMap(sight, x, y float32) error {
+	return e.EnterMap3D(sight, sight, sight, x, y, 0)
+}
+
+// EnterMapWithSight 以矩形视野进入场景，sightX、sightY分别是X轴、Y轴方向的视野半宽
+// 2D场景的Z坐标都是0，Z轴视野取任意正数效果都一样，这里使用sightY
+func (e *Entity) EnterMapWithSight(sightX, sightY, x, y float32) error {
+	return e.EnterMap3D(sightX, sightY, sightY, x, y, 0)
+}
+
+// EnterMap3D 以长方体视野进入三维场景，已经在场景里或者场景里已有同样id的Entity时返回aoi.ErrEntityExists，
+// 视野半宽必须为正数，否则上下哨兵的顺序会颠倒
+func (e *Entity) EnterMap3D(sightX, sightY, sightZ, x, y, z float32) error {
+	s := e.scene
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	return e.enterMap3D(sightX, sightY, sightZ, x, y, z)
+}
+
+func (e *Entity) LeaveMap() {
+	s := e.scene
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	e.leaveMap()
 }
 
-func (e *Entity) EnterMap(sight, x, y int) {
+// ChangePosition 在当前高度上平移
+func (e *Entity) ChangePosition(x, y float32) {
+	s := e.scene
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	if e.SightX == InvalidSight {
+		return
+	}
+	s.ChangePosition(e, x, y, e.ZNode[1].Value)
+}
+
+func (e *Entity) ChangePosition3D(x, y, z float32) {
+	s := e.scene
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	if e.SightX == InvalidSight {
+		return
+	}
+	s.ChangePosition(e, x, y, z)
+}
+
+// SetSight 运行时修改视野范围(比如塔升级、Boss狂暴)，Z轴视野保持不变，只会给自己发送进出视野的事件
+func (e *Entity) SetSight(sightX, sightY float32) error {
+	s := e.scene
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	return e.setSight3D(sightX, sightY, e.SightZ)
+}
+
+func (e *Entity) SetSight3D(sightX, sightY, sightZ float32) error {
+	s := e.scene
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	return e.setSight3D(sightX, sightY, sightZ)
+}
+
+// 以下方法均需要持锁调用
+
+func (e *Entity) enterMap3D(sightX, sightY, sightZ, x, y, z float32) error {
+	if e.SightX != InvalidSight {
+		return aoi.ErrEntityExists
+	}
+	if sightX <= 0 || sightY <= 0 || sightZ <= 0 {
+		return ErrInvalidSight
+	}
+	if _, ok := e.scene.entityMap[e.Id]; ok {
+		return aoi.ErrEntityExists
+	}
 	id := e.Id
-	x1sentinel := &Node{ID: id, Category: NodeSentinelDown, Value: x - sight}
+	x1sentinel := &Node{ID: id, Category: NodeSentinelDown, Value: x - sightX}
 	xNode := &Node{ID: id, Category: NodeEntity, Value: x}
-	x2sentinel := &Node{ID: id, Category: NodeSentinelUp, Value: x + sight}
+	x2sentinel := &Node{ID: id, Category: NodeSentinelUp, Value: x + sightX}
 
-	y1sentinel := &Node{ID: id, Category: NodeSentinelDown, Value: y - sight}
+	y1sentinel := &Node{ID: id, Category: NodeSentinelDown, Value: y - sightY}
 	yNode := &Node{ID: id, Category: NodeEntity, Value: y}
-	y2sentinel := &Node{ID: id, Category: NodeSentinelUp, Value: y + sight}
+	y2sentinel := &Node{ID: id, Category: NodeSentinelUp, Value: y + sightY}
 
-	e.Sight = sight
+	z1sentinel := &Node{ID: id, Category: NodeSentinelDown, Value: z - sightZ}
+	zNode := &Node{ID: id, Category: NodeEntity, Value: z}
+	z2sentinel := &Node{ID: id, Category: NodeSentinelUp, Value: z + sightZ}
+
+	e.SightX, e.SightY, e.SightZ = sightX, sightY, sightZ
 	e.XNode = [3]*Node{x1sentinel, xNode, x2sentinel}
 	e.YNode = [3]*Node{y1sentinel, yNode, y2sentinel}
-	NodeManager.AddEntity(e)
+	e.ZNode = [3]*Node{z1sentinel, zNode, z2sentinel}
+	e.scene.AddEntity(e)
+	return nil
 }
 
-func (e *Entity) LeaveMap() {
+func (e *Entity) leaveMap() {
 	// 说明没有进入Map
-	if e.Sight == InvalidSight {
+	if e.SightX == InvalidSight {
 		return
 	}
-	NodeManager.RemoveEntity(e)
+	e.scene.RemoveEntity(e)
+	e.SightX, e.SightY, e.SightZ = InvalidSight, InvalidSight, InvalidSight
 }
 
-func (e *Entity) ChangePosition(x, y int) {
-	NodeManager.ChangePosition(e, x, y)
+func (e *Entity) setSight3D(sightX, sightY, sightZ float32) error {
+	if e.SightX == InvalidSight {
+		return aoi.ErrEntityNotFound
+	}
+	if sightX <= 0 || sightY <= 0 || sightZ <= 0 {
+		return ErrInvalidSight
+	}
+	e.scene.ChangeSight(e, sightX, sightY, sightZ)
+	return nil
 }
 
-func (e *Entity) SendMessage(data any) {
-	fmt.Printf("%d receive message: %+v\n", e.Id, data)
+func (e *Entity) position() aoi.Position {
+	return aoi.Position{X: e.XNode[1].Value, Y: e.YNode[1].Value, Z: e.ZNode[1].Value}
+}
+
+// 把target相关的事件暂存起来，释放锁之后再投递给自己的Listener
+func (e *Entity) sendEvent(category aoi.EventType, target *Entity) {
+	ev := aoi.Event{
+		Type:      category,
+		WatcherId: e.Id,
+		TargetId:  target.Id,
+		Position:  target.position(),
+	}
+	if e.scene.silent {
+		return
+	}
+	if e.scene.buffer != nil {
+		e.scene.buffer.Add(ev)
+		return
+	}
+	e.scene.dispatcher.Add(e.Listener, ev)
 }
@@ -1,19 +1,548 @@
 package crosschain
 
-import "testing"
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"game-toolkit/aoi"
+	"game-toolkit/aoi/aoitest"
+)
+
+type recorder struct {
+	events []aoi.Event
+}
+
+func (r *recorder) OnEvent(ev aoi.Event) {
+	r.events = append(r.events, ev)
+}
+
+func (r *recorder) has(category aoi.EventType, targetId int64) bool {
+	for _, ev := range r.events {
+		if ev.Type == category && ev.TargetId == targetId {
+			return true
+		}
+	}
+	return false
+}
 
 func TestSight(t *testing.T) {
-	e1 := NewEntity()
-	e2 := NewEntity()
-	e3 := NewEntity()
+	scene := NewScene(Config{})
+	e1 := scene.NewEntity()
+	e2 := scene.NewEntity()
+	e3 := scene.NewEntity()
+	r1, r2, r3 := &recorder{}, &recorder{}, &recorder{}
+	e1.Listener, e2.Listener, e3.Listener = r1, r2, r3
 
 	e1.EnterMap(100, 0, 0)
-	t.Log("-------------------")
 	e2.EnterMap(100, 1, 1)
-	t.Log("-------------------")
+	if !r1.has(aoi.EventEnter, e2.Id) || !r2.has(aoi.EventSync, e1.Id) {
+		t.Fatalf("e1 and e2 should see each other")
+	}
 	e3.EnterMap(500, 300, 200)
-	t.Log("-------------------")
+	if r1.has(aoi.EventEnter, e3.Id) || !r3.has(aoi.EventSync, e1.Id) {
+		t.Fatalf("e3 should see e1, e1 should not see e3")
+	}
 	e2.ChangePosition(350, 250)
-	t.Log("-------------------")
+	if !r1.has(aoi.EventLeave, e2.Id) || !r3.has(aoi.EventMove, e2.Id) {
+		t.Fatalf("e1 should lose e2, e3 should see e2 move")
+	}
 	e3.LeaveMap()
+	if !r2.has(aoi.EventLeave, e3.Id) {
+		t.Fatalf("e2 should see e3 leave")
+	}
+}
+
+func TestRectSight(t *testing.T) {
+	// 横版游戏，X方向看得远，Y方向看得近
+	scene := NewScene(Config{SightX: 50, SightY: 5})
+	r1 := &recorder{}
+	scene.Enter(1, aoi.Position{X: 0, Y: 0}, r1)
+	scene.Enter(2, aoi.Position{X: 40, Y: 2}, nil)
+	scene.Enter(3, aoi.Position{X: 2, Y: 10}, nil)
+	if !r1.has(aoi.EventEnter, 2) || r1.has(aoi.EventEnter, 3) {
+		t.Fatalf("1 should see 2 only: %v", scene.Visible(1))
+	}
+}
+
+func TestSetSight(t *testing.T) {
+	scene := NewScene(Config{Sight: 10})
+	tower, r2 := &recorder{}, &recorder{}
+	scene.Enter(1, aoi.Position{X: 0, Y: 0}, tower)
+	scene.Enter(2, aoi.Position{X: 15, Y: 0}, r2)
+	scene.Enter(3, aoi.Position{X: 0, Y: 25}, nil)
+	if len(scene.Visible(1)) != 0 {
+		t.Fatalf("tower should see nothing: %v", scene.Visible(1))
+	}
+
+	// 塔升级，视野变大
+	if err := scene.SetSight(1, 20, 30); err != nil {
+		t.Fatalf("set sight: %v", err)
+	}
+	if !tower.has(aoi.EventSync, 2) || !tower.has(aoi.EventSync, 3) {
+		t.Fatalf("tower should see 2 and 3: %v", scene.Visible(1))
+	}
+	// 别人能否看到塔不受影响
+	if len(r2.events) != 0 {
+		t.Fatalf("2 should receive nothing: %v", r2.events)
+	}
+
+	tower.events = nil
+	scene.SetSight(1, 20, 20)
+	if !tower.has(aoi.EventLeave, 3) || tower.has(aoi.EventLeave, 2) {
+		t.Fatalf("tower should lose 3 only: %v", tower.events)
+	}
+	// 新视野下移动依然正确
+	scene.Move(2, aoi.Position{X: 25, Y: 0})
+	if !tower.has(aoi.EventLeave, 2) {
+		t.Fatalf("tower should lose 2 after it moved away")
+	}
+
+	if err := scene.SetSight(1, 0, 10); !errors.Is(err, ErrInvalidSight) {
+		t.Fatalf("invalid sight: %v", err)
+	}
+	if err := scene.SetSight(4, 10, 10); !errors.Is(err, aoi.ErrEntityNotFound) {
+		t.Fatalf("unknown entity: %v", err)
+	}
+
+	// 进场时同样拒绝非正数的视野，失败之后还可以用合法的视野进场
+	e := scene.NewEntity()
+	for _, sight := range []float32{0, -5} {
+		if err := e.EnterMap(sight, 1, 1); !errors.Is(err, ErrInvalidSight) {
+			t.Fatalf("enter with sight %v: %v", sight, err)
+		}
+	}
+	if err := e.EnterMapWithSight(10, 0, 1, 1); !errors.Is(err, ErrInvalidSight) {
+		t.Fatalf("enter with zero sight y: %v", err)
+	}
+	if err := e.EnterMap(10, 1, 1); err != nil {
+		t.Fatalf("enter after invalid sight: %v", err)
+	}
+	if err := scene.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFloors(t *testing.T) {
+	scene := NewScene(Config{Sight: 10, SightZ: 3})
+	r1 := &recorder{}
+	scene.Enter(1, aoi.Position{X: 0, Y: 0, Z: 0}, r1)
+	scene.Enter(2, aoi.Position{X: 1, Y: 1, Z: 5}, nil)
+	scene.Enter(3, aoi.Position{X: 1, Y: 1, Z: 2}, nil)
+	if r1.has(aoi.EventEnter, 2) || !r1.has(aoi.EventEnter, 3) {
+		t.Fatalf("1 should see 3 only: %v", scene.Visible(1))
+	}
+	// 上楼之后看不到原来楼层的3，看到了2
+	scene.Move(1, aoi.Position{X: 0, Y: 0, Z: 6})
+	if !r1.has(aoi.EventSync, 2) || !r1.has(aoi.EventLeave, 3) {
+		t.Fatalf("1 should see 2 and lose 3: %v", scene.Visible(1))
+	}
+	for _, ev := range r1.events {
+		if ev.TargetId == 2 && ev.Position.Z != 5 {
+			t.Fatalf("event position %+v", ev.Position)
+		}
+	}
+	if err := scene.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 以指定id进入之后，NewEntity不会再生成这个id，同样id的Entity也进不来
+func TestDuplicateId(t *testing.T) {
+	scene := NewScene(Config{})
+	id := atomic.LoadInt64(&EntityIdGen) + 1
+	if err := scene.Enter(id, aoi.Position{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if e := scene.NewEntity(); e.Id == id {
+		t.Fatalf("NewEntity reused id %d", id)
+	}
+	dup := scene.NewEntity()
+	dup.Id = id
+	if err := dup.EnterMap(10, 1, 1); err != aoi.ErrEntityExists {
+		t.Fatalf("enter with duplicate id: %v", err)
+	}
+	if err := scene.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	scene.Leave(id)
+	if len(scene.entityMap) != 0 {
+		t.Fatalf("scene should be empty")
+	}
+	if err := scene.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Listener里再调用场景的方法，不能看到改了一半的链表
+func TestReentrantListener(t *testing.T) {
+	scene := NewScene(Config{Sight: 5})
+	var listener aoi.ListenerFunc
+	listener = func(ev aoi.Event) {
+		scene.Visible(ev.WatcherId)
+		// 挪到远处之后只会看到同样被挪过去的，不会无限地触发下去
+		if ev.Type == aoi.EventEnter && ev.TargetId%5 == 0 {
+			_ = scene.Move(ev.TargetId, aoi.Position{X: -100})
+		}
+	}
+
+	var wg sync.WaitGroup
+	for w := int64(0); w < 4; w++ {
+		wg.Add(1)
+		go func(w int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(w))
+			for i := int64(1); i <= 50; i++ {
+				id := w*100 + i
+				_ = scene.Enter(id, aoi.Position{X: float32(rnd.Intn(20)), Y: float32(rnd.Intn(20))}, listener)
+				_ = scene.Move(id, aoi.Position{X: float32(rnd.Intn(20)), Y: float32(rnd.Intn(20))})
+				if i%3 == 0 {
+					_ = scene.Leave(id)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if n := len(scene.Snapshot().Entities); n != 4*(50-16) {
+		t.Fatalf("unexpected entity count %d", n)
+	}
+	if err := scene.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	aoitest.RunConformance(t, func() aoi.Scene { return NewScene(Config{Sight: 10}) }, aoitest.Options{})
+	aoitest.RunConformance(t, func() aoi.Scene { return NewScene(Config{Sight: 10, Batch: true}) }, aoitest.Options{})
+	aoitest.RunConformance(t, func() aoi.Scene { return NewScene(Config{Sight: 10, Hysteresis: 3}) }, aoitest.Options{})
+}
+
+func TestCapped(t *testing.T) {
+	aoitest.RunCapped(t, func() aoi.Scene { return NewScene(Config{Sight: 10}) })
+}
+
+func TestSnapshot(t *testing.T) {
+	aoitest.RunSnapshot(t, func() aoi.Scene { return NewScene(Config{Sight: 10}) })
+	aoitest.RunSnapshot(t, func() aoi.Scene { return NewScene(Config{Sight: 10, Batch: true}) })
+
+	// 每个Entity的视野都原样恢复
+	scene := NewScene(Config{Sight: 10})
+	scene.Enter(1, aoi.Position{}, nil)
+	scene.Enter(2, aoi.Position{X: 30}, nil)
+	scene.SetSight3D(1, 50, 5, 5)
+	restored := NewScene(Config{Sight: 10})
+	if err := restored.Restore(scene.Snapshot(), nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if e := restored.GetEntity(1); e.SightX != 50 || e.SightY != 5 || e.SightZ != 5 {
+		t.Fatalf("sight not restored: %v %v %v", e.SightX, e.SightY, e.SightZ)
+	}
+	if err := restored.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if len(restored.Visible(1)) != 1 || len(restored.Visible(2)) != 0 {
+		t.Fatalf("unexpected visible after restore")
+	}
+}
+
+func TestOcclusion(t *testing.T) {
+	aoitest.RunOcclusion(t, func() aoi.Scene { return NewScene(Config{Sight: 10}) })
+	aoitest.RunOcclusion(t, func() aoi.Scene { return NewScene(Config{Sight: 10, Batch: true}) })
+}
+
+func TestWorld(t *testing.T) {
+	aoitest.RunWorld(t, func() aoi.Scene { return NewScene(Config{Sight: 10}) })
+	aoitest.RunWorld(t, func() aoi.Scene { return NewScene(Config{Sight: 10, Batch: true}) })
+}
+
+func (r *recorder) count(targetId int64) (enters, leaves int) {
+	for _, ev := range r.events {
+		if ev.TargetId != targetId {
+			continue
+		}
+		switch ev.Type {
+		case aoi.EventEnter, aoi.EventSync:
+			enters++
+		case aoi.EventLeave:
+			leaves++
+		}
+	}
+	return
+}
+
+func TestHysteresis(t *testing.T) {
+	// 在视野边界上来回移动
+	oscillate := func(config Config, move func(scene *Scene)) (r *recorder, scene *Scene) {
+		scene = NewScene(config)
+		r = &recorder{}
+		scene.Enter(1, aoi.Position{}, r)
+		scene.Enter(2, aoi.Position{X: 9.9}, nil)
+		for i := 0; i < 10; i++ {
+			move(scene)
+		}
+		return
+	}
+	target := func(scene *Scene) {
+		scene.Move(2, aoi.Position{X: 10.1})
+		scene.Move(2, aoi.Position{X: 9.9})
+	}
+	r, _ := oscillate(Config{Sight: 10}, target)
+	if enters, leaves := r.count(2); enters != 11 || leaves != 10 {
+		t.Fatalf("without hysteresis expect 11 enters and 10 leaves, got %d and %d", enters, leaves)
+	}
+	r, scene := oscillate(Config{Sight: 10, Hysteresis: 2}, target)
+	if enters, leaves := r.count(2); enters != 1 || leaves != 0 {
+		t.Fatalf("with hysteresis expect 1 enter and no leave, got %d and %d", enters, leaves)
+	}
+	if err := scene.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	scene.Move(2, aoi.Position{X: 11.9})
+	if _, leaves := r.count(2); leaves != 0 {
+		t.Fatalf("should not leave inside hysteresis")
+	}
+	scene.Move(2, aoi.Position{X: 12})
+	if _, leaves := r.count(2); leaves != 1 {
+		t.Fatalf("should leave on the hysteresis border")
+	}
+
+	// 观察者自己来回移动
+	r, scene = oscillate(Config{Sight: 10, Hysteresis: 2}, func(scene *Scene) {
+		scene.Move(1, aoi.Position{X: -0.1})
+		scene.Move(1, aoi.Position{X: 0.1})
+	})
+	if enters, leaves := r.count(2); enters != 1 || leaves != 0 {
+		t.Fatalf("watcher oscillation expect 1 enter and no leave, got %d and %d", enters, leaves)
+	}
+
+	// 缩小视野之后，防抖范围外的立即离开，防抖范围内的保留
+	scene.Enter(3, aoi.Position{X: -8}, nil)
+	scene.SetSight(1, 7, 7)
+	if !r.has(aoi.EventLeave, 2) || r.has(aoi.EventLeave, 3) {
+		t.Fatalf("shrinking sight should drop 2 and keep 3")
+	}
+	if err := scene.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVisibility(t *testing.T) {
+	hidden := map[int64]bool{}
+	scene := NewScene(Config{Filter: func(watcher, target int64) bool {
+		return !hidden[target]
+	}})
+	r1, r2 := &recorder{}, &recorder{}
+	scene.Enter(1, aoi.Position{X: 1, Y: 1}, r1)
+	scene.Enter(2, aoi.Position{X: 2, Y: 2}, r2)
+
+	// 隐身的GM能看到别人，别人看不到GM
+	scene.SetVisibility(2, aoi.Visibility{Mask: aoi.DefaultVisibility.Mask})
+	if !r1.has(aoi.EventLeave, 2) || r2.has(aoi.EventLeave, 1) {
+		t.Fatalf("1 should lose the invisible gm only")
+	}
+	if len(scene.Visible(1)) != 0 || len(scene.Visible(2)) != 1 {
+		t.Fatalf("visible: 1 %v, 2 %v", scene.Visible(1), scene.Visible(2))
+	}
+	scene.SetVisibility(2, aoi.DefaultVisibility)
+	if !r1.has(aoi.EventEnter, 2) {
+		t.Fatalf("1 should see gm again")
+	}
+
+	hidden[1] = true
+	scene.Refresh(1)
+	if !r2.has(aoi.EventLeave, 1) {
+		t.Fatalf("2 should lose filtered 1")
+	}
+}
+
+// 根据收到的事件维护每个Watcher眼里的可见集合
+type sightTracker struct {
+	visible map[int64]map[int64]struct{}
+}
+
+func (st *sightTracker) listener(id int64) aoi.Listener {
+	st.visible[id] = make(map[int64]struct{})
+	return aoi.ListenerFunc(func(ev aoi.Event) {
+		switch ev.Type {
+		case aoi.EventEnter, aoi.EventSync:
+			st.visible[ev.WatcherId][ev.TargetId] = struct{}{}
+		case aoi.EventLeave:
+			delete(st.visible[ev.WatcherId], ev.TargetId)
+		}
+	})
+}
+
+func TestIncrementalMove(t *testing.T) {
+	const (
+		count = 60
+		sight = 10
+		size  = 100
+	)
+	rnd := rand.New(rand.NewSource(1))
+	scene := NewScene(Config{Sight: sight})
+	st := &sightTracker{visible: make(map[int64]map[int64]struct{})}
+	positions := make(map[int64]aoi.Position)
+	for id := int64(1); id <= count; id++ {
+		pos := aoi.Position{X: float32(rnd.Intn(size)), Y: float32(rnd.Intn(size))}
+		positions[id] = pos
+		scene.Enter(id, pos, st.listener(id))
+	}
+
+	for i := 0; i < 2000; i++ {
+		id := int64(rnd.Intn(count) + 1)
+		pos := positions[id]
+		if i%10 == 0 {
+			// 偶尔瞬移到很远的地方
+			pos = aoi.Position{X: float32(rnd.Intn(size)), Y: float32(rnd.Intn(size))}
+		} else {
+			pos.X += float32(rnd.Intn(2*sight+1) - sight)
+			pos.Y += float32(rnd.Intn(2*sight+1) - sight)
+		}
+		positions[id] = pos
+		scene.Move(id, pos)
+
+		for watcher, wp := range positions {
+			for target, tp := range positions {
+				_, got := st.visible[watcher][target]
+				expect := watcher != target && abs(wp.X-tp.X) < sight && abs(wp.Y-tp.Y) < sight
+				if got != expect {
+					t.Fatalf("move %d: %d sees %d is %v, expect %v", i, watcher, target, got, expect)
+				}
+			}
+			if len(scene.Visible(watcher)) != len(st.visible[watcher]) {
+				t.Fatalf("move %d: visible of %d mismatch", i, watcher)
+			}
+		}
+	}
+
+	// 增量维护的观察者集合和原来逐个扫描的结果一致
+	for id := range positions {
+		got := make(map[int64]struct{})
+		for _, e := range scene.GetOtherSightEntities(id) {
+			got[e.Id] = struct{}{}
+		}
+		expect := legacyGetOtherSightEntities(&scene.nodeManager, id)
+		if len(got) != len(expect) {
+			t.Fatalf("observers of %d: %d, expect %d", id, len(got), len(expect))
+		}
+		for _, e := range expect {
+			if _, ok := got[e.Id]; !ok {
+				t.Fatalf("%d should be observer of %d", e.Id, id)
+			}
+		}
+	}
+
+	if err := scene.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func abs(v float32) float32 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// 原来的实现: 遍历整条X链和Y链，找出视野范围覆盖了id的Entity，用来对比增量维护的观察者集合
+func legacyGetOtherSightEntities(m *nodeManager, id int64) (result []*Entity) {
+	self, ok := m.entityMap[id]
+	if !ok {
+		return
+	}
+
+	xIds := make(map[int64]struct{})
+	for n := m.XNodeHead; n != nil; n = n.Next {
+		if n.Category != NodeEntity || n.ID == id {
+			continue
+		}
+		other := m.entityMap[n.ID]
+		if float32(math.Abs(float64(n.Value-self.XNode[1].Value))) < other.SightX {
+			xIds[n.ID] = struct{}{}
+		}
+	}
+
+	for n := m.YNodeHead; n != nil; n = n.Next {
+		if n.Category != NodeEntity || n.ID == id {
+			continue
+		}
+		other := m.entityMap[n.ID]
+		if float32(math.Abs(float64(n.Value-self.YNode[1].Value))) >= other.SightY {
+			continue
+		}
+		// X轴和Y轴均有交集，那么说明是要找的entity
+		if _, ok := xIds[n.ID]; ok {
+			result = append(result, m.entityMap[n.ID])
+		}
+	}
+	return
+}
+
+// 平均每个Entity视野内有十来个Entity
+func newBenchScene(count int) *Scene {
+	const sight = 10
+	size := int(math.Sqrt(float64(count))) * 2 * sight
+	rnd := rand.New(rand.NewSource(1))
+	scene := NewScene(Config{Sight: sight})
+	for id := int64(1); id <= int64(count); id++ {
+		scene.Enter(id, aoi.Position{X: float32(rnd.Intn(size)), Y: float32(rnd.Intn(size))}, nil)
+	}
+	return scene
+}
+
+func BenchmarkGetOtherSightEntities(b *testing.B) {
+	for _, count := range []int{1000, 10000} {
+		scene := newBenchScene(count)
+		b.Run(fmt.Sprintf("legacy/%d", count), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				legacyGetOtherSightEntities(&scene.nodeManager, int64(i%count+1))
+			}
+		})
+		b.Run(fmt.Sprintf("observers/%d", count), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				scene.GetOtherSightEntities(int64(i%count + 1))
+			}
+		})
+	}
+}
+
+func BenchmarkMove(b *testing.B) {
+	for _, count := range []int{1000, 10000} {
+		scene := newBenchScene(count)
+		rnd := rand.New(rand.NewSource(2))
+		b.Run(fmt.Sprintf("%d", count), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				e := scene.GetEntity(int64(i%count + 1))
+				e.ChangePosition(e.XNode[1].Value+float32(rnd.Intn(5)-2), e.YNode[1].Value+float32(rnd.Intn(5)-2))
+			}
+		})
+	}
+}
+
+func TestFloatPosition(t *testing.T) {
+	scene := NewScene(Config{Sight: 2.5})
+	r1 := &recorder{}
+	scene.Enter(1, aoi.Position{X: 0.1, Y: 0.1}, r1)
+	// 刚好在视野边界上的看不到，往里挪一点就能看到
+	scene.Enter(2, aoi.Position{X: 0.1 + 2.5, Y: 0.1}, nil)
+	if r1.has(aoi.EventEnter, 2) {
+		t.Fatalf("entity on the sentinel should not be visible")
+	}
+	scene.Move(2, aoi.Position{X: 2.59, Y: 0.1})
+	if !r1.has(aoi.EventEnter, 2) {
+		t.Fatalf("entity inside the sentinel should be visible")
+	}
+
+	// 大量亚单位的小步移动之后，哨兵依然和视野半宽一致
+	e := scene.GetEntity(1)
+	for i := 0; i < 1000; i++ {
+		e.ChangePosition(e.XNode[1].Value+0.01, e.YNode[1].Value-0.003)
+	}
+	if err := scene.Validate(); err != nil {
+		t.Fatal(err)
+	}
 }
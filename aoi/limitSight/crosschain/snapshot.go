@@ -0,0 +1,70 @@
+package crosschain
+
+import (
+	"sort"
+
+	"game-toolkit/aoi"
+)
+
+var _ aoi.Snapshotter = (*Scene)(nil)
+
+// Snapshot 导出场景内所有Entity的位置、视野和可见性掩码
+func (s *Scene) Snapshot() (snap aoi.Snapshot) {
+	s.Lock()
+	defer s.Unlock()
+	snap.Entities = make([]aoi.EntitySnapshot, 0, len(s.entityMap))
+	for _, e := range s.entityMap {
+		snap.Entities = append(snap.Entities, aoi.EntitySnapshot{
+			Id:         e.Id,
+			Position:   aoi.Position{X: e.XNode[1].Value, Y: e.YNode[1].Value, Z: e.ZNode[1].Value},
+			SightX:     e.SightX,
+			SightY:     e.SightY,
+			SightZ:     e.SightZ,
+			Visibility: e.visibility,
+		})
+	}
+	sort.Slice(snap.Entities, func(i, j int) bool { return snap.Entities[i].Id < snap.Entities[j].Id })
+	return
+}
+
+// Restore 按快照重建Entity，快照里没有视野的Entity使用场景的默认视野
+func (s *Scene) Restore(snap aoi.Snapshot, listener func(id int64) aoi.Listener, notify bool) error {
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	// 先整体检查一遍，出错时场景保持不变
+	ids := make(map[int64]struct{}, len(snap.Entities))
+	for _, es := range snap.Entities {
+		if _, ok := s.entityMap[es.Id]; ok {
+			return aoi.ErrEntityExists
+		}
+		if _, ok := ids[es.Id]; ok {
+			return aoi.ErrEntityExists
+		}
+		if es.SightX < 0 || es.SightY < 0 || es.SightZ < 0 {
+			return ErrInvalidSight
+		}
+		ids[es.Id] = struct{}{}
+	}
+
+	s.silent = !notify
+	defer func() { s.silent = false }()
+	for _, es := range snap.Entities {
+		e := &Entity{Id: es.Id, SightX: InvalidSight, SightY: InvalidSight, SightZ: InvalidSight, scene: s, visibility: es.Visibility}
+		if listener != nil {
+			e.Listener = listener(es.Id)
+		}
+		sightX, sightY, sightZ := es.SightX, es.SightY, es.SightZ
+		if sightX == 0 {
+			sightX = s.config.SightX
+		}
+		if sightY == 0 {
+			sightY = s.config.SightY
+		}
+		if sightZ == 0 {
+			sightZ = s.config.SightZ
+		}
+		e.enterMap3D(sightX, sightY, sightZ, es.Position.X, es.Position.Y, es.Position.Z)
+		aoi.ReserveId(&EntityIdGen, es.Id)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package crosschain
+
+import "fmt"
+
+// Validate 持锁检查场景的不变量，见nodeManager.Validate
+func (s *Scene) Validate() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.nodeManager.Validate()
+}
+
+// Validate 检查十字链表和各个集合的不变量，用于测试和排查问题，开销较大，不要在每帧里调用
+// 1. 每个链表从头节点有序地走到尾节点，前后指针互相对应
+// 2. 链表里的节点和场景里的Entity一一对应，哨兵和自身节点的距离等于视野半宽
+// 3. 几何覆盖集合和哨兵的位置一致(开启防抖时介于视野和防抖范围之间的可以在集合里)，可见集合是覆盖集合的子集，双向的集合互相对应
+func (m *nodeManager) Validate() error {
+	if err := m.validateList(m.XNodeHead, m.xNodeTail, AxisX); err != nil {
+		return err
+	}
+	if err := m.validateList(m.YNodeHead, m.yNodeTail, AxisY); err != nil {
+		return err
+	}
+	if err := m.validateList(m.ZNodeHead, m.zNodeTail, AxisZ); err != nil {
+		return err
+	}
+
+	for id, e := range m.entityMap {
+		// 和进场、移动时的计算方式保持一致，浮点数才能精确相等
+		if e.XNode[0].Value != e.XNode[1].Value-e.SightX || e.XNode[2].Value != e.XNode[1].Value+e.SightX {
+			return fmt.Errorf("crosschain: entity %d x sentinels do not match sight %v", id, e.SightX)
+		}
+		if e.YNode[0].Value != e.YNode[1].Value-e.SightY || e.YNode[2].Value != e.YNode[1].Value+e.SightY {
+			return fmt.Errorf("crosschain: entity %d y sentinels do not match sight %v", id, e.SightY)
+		}
+		if e.ZNode[0].Value != e.ZNode[1].Value-e.SightZ || e.ZNode[2].Value != e.ZNode[1].Value+e.SightZ {
+			return fmt.Errorf("crosschain: entity %d z sentinels do not match sight %v", id, e.SightZ)
+		}
+
+		for n := e.XNode[0]; n != e.XNode[2]; n = n.Next {
+			if n.Category != NodeEntity || n.ID == id || !m.inSight(e, m.entityMap[n.ID]) {
+				continue
+			}
+			if _, ok := e.inRange[n.ID]; !ok {
+				return fmt.Errorf("crosschain: entity %d covers %d but it is not in range", id, n.ID)
+			}
+		}
+		for targetId := range e.inRange {
+			// 不防抖时inLeaveRange就是inSight，覆盖集合和哨兵范围内的Entity完全一致
+			if !m.inLeaveRange(e, m.entityMap[targetId]) {
+				return fmt.Errorf("crosschain: entity %d keeps covering %d out of range", id, targetId)
+			}
+			if _, ok := m.entityMap[targetId].observers[id]; !ok {
+				return fmt.Errorf("crosschain: entity %d covers %d but is not its observer", id, targetId)
+			}
+		}
+		for watcherId := range e.observers {
+			if _, ok := m.entityMap[watcherId].inRange[id]; !ok {
+				return fmt.Errorf("crosschain: entity %d is observed by %d but not in its range", id, watcherId)
+			}
+		}
+		for targetId := range e.watching {
+			if _, ok := e.inRange[targetId]; !ok {
+				return fmt.Errorf("crosschain: entity %d watches %d out of range", id, targetId)
+			}
+			if _, ok := m.entityMap[targetId].watchedBy[id]; !ok {
+				return fmt.Errorf("crosschain: entity %d watches %d but is not in its watchers", id, targetId)
+			}
+		}
+		for watcherId := range e.watchedBy {
+			if _, ok := m.entityMap[watcherId].watching[id]; !ok {
+				return fmt.Errorf("crosschain: entity %d is watched by %d but not in its watching", id, watcherId)
+			}
+		}
+	}
+	return nil
+}
+
+func (m *nodeManager) validateList(head, tail *Node, category int) error {
+	if head == nil || head.Category != NodeHead || head.Front != nil {
+		return fmt.Errorf("crosschain: axis %d has invalid head", category)
+	}
+	count := 0
+	n := head
+	for ; n != tail; n = n.Next {
+		if n.Next == nil {
+			return fmt.Errorf("crosschain: axis %d ends before tail", category)
+		}
+		if n.Next.Front != n {
+			return fmt.Errorf("crosschain: axis %d broken back link after %+v", category, *n)
+		}
+		if !nodeLess(n, n.Next) {
+			return fmt.Errorf("crosschain: axis %d out of order at %+v", category, *n)
+		}
+		if n == head {
+			continue
+		}
+		e, ok := m.entityMap[n.ID]
+		if !ok {
+			return fmt.Errorf("crosschain: axis %d has node of unknown entity %d", category, n.ID)
+		}
+		nodes := e.XNode
+		switch category {
+		case AxisY:
+			nodes = e.YNode
+		case AxisZ:
+			nodes = e.ZNode
+		}
+		if nodes[0] != n && nodes[1] != n && nodes[2] != n {
+			return fmt.Errorf("crosschain: axis %d has stale node of entity %d", category, n.ID)
+		}
+		count++
+	}
+	if n.Category != NodeTail || n.Next != nil {
+		return fmt.Errorf("crosschain: axis %d has invalid tail", category)
+	}
+	if count != 3*len(m.entityMap) {
+		return fmt.Errorf("crosschain: axis %d has %d nodes, expect %d", category, count, 3*len(m.entityMap))
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package grid
+
+/*
+	[思路]
+	格子在第一次有Entity进入时才创建，玩家在野外到处跑，走过的格子如果一直保留，长期运行的服务器上空格子只增不减
+	默认格子空了就立即从GridCache里删除；Entity在格子边界上来回移动时会反复删除、创建同一个格子，
+	所以删除的格子放进场景自己的池子里复用，池子的大小有上限，空格子再多也不会一直占着内存
+	配置了DeferReclaim时空格子先留在GridCache里，由调用方定期调用Sweep统一回收，回收时同样放进池子
+	池子和格子一样由场景的锁保护，不需要sync.Pool
+*/
+
+// cellPool 空格子的回收和复用，以及监控用的计数，需要持锁访问
+type cellPool struct {
+	free      []*Grid // 可以复用的空格子
+	empty     int     // GridCache里没有Entity的格子数，只有DeferReclaim时才可能不为0
+	allocated uint64  // 累计新分配的格子数
+	reclaimed uint64  // 累计回收的格子数
+}
+
+func (p *cellPool) get() *Grid {
+	if n := len(p.free); n > 0 {
+		grid := p.free[n-1]
+		p.free[n-1] = nil
+		p.free = p.free[:n-1]
+		return grid
+	}
+	p.allocated++
+	return &Grid{EntityCache: make(map[int64]*Entity)}
+}
+
+func (p *cellPool) put(grid *Grid, limit int) {
+	p.reclaimed++
+	if len(p.free) < limit {
+		p.free = append(p.free, grid)
+	}
+}
+
+// 场景销毁时丢掉池子里的格子，累计的计数保留
+func (p *cellPool) reset() {
+	p.free = nil
+	p.empty = 0
+}
+
+// Stats 格子的数量，用于监控内存占用
+type Stats struct {
+	Cells          int    // GridCache里的格子数
+	EmptyCells     int    // 其中没有Entity、等待Sweep回收的格子数
+	PooledCells    int    // 池子里等待复用的格子数
+	CellsAllocated uint64 // 累计新分配的格子数
+	CellsReclaimed uint64 // 累计回收的格子数
+}
+
+func (s *Scene) Stats() Stats {
+	s.Lock()
+	defer s.Unlock()
+	return Stats{
+		Cells:          len(s.GridCache),
+		EmptyCells:     s.cells.empty,
+		PooledCells:    len(s.cells.free),
+		CellsAllocated: s.cells.allocated,
+		CellsReclaimed: s.cells.reclaimed,
+	}
+}
+
+// Sweep 回收所有的空格子，返回回收的数量，没有配置DeferReclaim时空格子已经立即回收了
+func (s *Scene) Sweep() (n int) {
+	s.Lock()
+	defer s.Unlock()
+	for gridId, grid := range s.GridCache {
+		if len(grid.EntityCache) == 0 {
+			s.reclaim(gridId, grid)
+			n++
+		}
+	}
+	s.cells.empty = 0
+	return
+}
+
+// 以下方法均需要持锁调用
+
+// 把Entity从格子里删掉，格子空了之后立即回收，配置了DeferReclaim时留给Sweep
+func (s *Scene) removeFromCell(gridId uint64, id int64) {
+	grid, ok := s.GridCache[gridId]
+	if !ok {
+		return
+	}
+	if _, ok := grid.EntityCache[id]; !ok {
+		return
+	}
+	delete(grid.EntityCache, id)
+	if len(grid.EntityCache) != 0 {
+		return
+	}
+	if s.config.DeferReclaim {
+		s.cells.empty++
+		return
+	}
+	s.reclaim(gridId, grid)
+}
+
+func (s *Scene) reclaim(gridId uint64, grid *Grid) {
+	delete(s.GridCache, gridId)
+	s.cells.put(grid, s.config.CellPoolSize)
+}
@@ -0,0 +1,118 @@
+package grid
+
+import (
+	"math/rand"
+	"testing"
+
+	"game-toolkit/aoi"
+)
+
+func TestCellReclaim(t *testing.T) {
+	scene := NewScene(Config{CellPoolSize: 4})
+	// 一个人在野外走了100个格子，身后不留下空格子
+	scene.Enter(1, aoi.Position{}, nil)
+	scene.Enter(2, aoi.Position{X: 5}, nil)
+	for i := 1; i <= 100; i++ {
+		if err := scene.Move(1, aoi.Position{X: float32(i * 10)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := scene.Stats()
+	if stats.Cells != 2 || stats.EmptyCells != 0 {
+		t.Fatalf("empty cells should be reclaimed: %+v", stats)
+	}
+	// 第一步离开的格子里还有2，之后每次离开格子的同时又进入了新的格子，回收的格子马上被复用
+	if stats.CellsAllocated != 2 || stats.CellsReclaimed != 99 {
+		t.Fatalf("cells should be reused: %+v", stats)
+	}
+
+	// 在格子边界上来回移动不会分配新的格子
+	for i := 0; i < 100; i++ {
+		scene.Move(1, aoi.Position{X: 999.5 + float32(i%2)})
+	}
+	if stats := scene.Stats(); stats.CellsAllocated != 2 {
+		t.Fatalf("oscillating should reuse cells: %+v", stats)
+	}
+
+	// 池子满了之后多余的格子直接丢掉
+	for id := int64(10); id < 20; id++ {
+		scene.Enter(id, aoi.Position{Y: float32(id * 100)}, nil)
+	}
+	for id := int64(10); id < 20; id++ {
+		scene.Leave(id)
+	}
+	if stats := scene.Stats(); stats.Cells != 2 || stats.PooledCells != 4 {
+		t.Fatalf("pool should be capped: %+v", stats)
+	}
+
+	scene.Close()
+	if stats := scene.Stats(); stats.Cells != 0 || stats.PooledCells != 0 {
+		t.Fatalf("close should drop all cells: %+v", stats)
+	}
+}
+
+func TestDeferReclaim(t *testing.T) {
+	scene := NewScene(Config{DeferReclaim: true})
+	scene.Enter(1, aoi.Position{}, nil)
+	for i := 1; i <= 10; i++ {
+		scene.Move(1, aoi.Position{X: float32(i * 10)})
+	}
+	if stats := scene.Stats(); stats.Cells != 11 || stats.EmptyCells != 10 {
+		t.Fatalf("empty cells should wait for sweep: %+v", stats)
+	}
+	// 回到空格子里，空格子的计数跟着减少
+	scene.Move(1, aoi.Position{X: 50})
+	if stats := scene.Stats(); stats.EmptyCells != 10 || len(scene.GridCache[scene.GetEntity(1).GridId].EntityCache) != 1 {
+		t.Fatalf("revisited cell should not be empty: %+v", stats)
+	}
+	if n := scene.Sweep(); n != 10 {
+		t.Fatalf("sweep %d cells, expect 10", n)
+	}
+	if stats := scene.Stats(); stats.Cells != 1 || stats.EmptyCells != 0 || stats.PooledCells != 10 {
+		t.Fatalf("sweep should reclaim all empty cells: %+v", stats)
+	}
+	scene.Leave(1)
+	if stats := scene.Stats(); stats.Cells != 1 || stats.EmptyCells != 1 {
+		t.Fatalf("leave should leave an empty cell: %+v", stats)
+	}
+}
+
+// 随机操作之后，GridCache里的格子和Entity的位置一致，空格子的计数正确
+func TestCellConsistency(t *testing.T) {
+	for _, config := range []Config{{CellPoolSize: 2}, {DeferReclaim: true, FloorHeight: 5}} {
+		scene := NewScene(config)
+		rnd := rand.New(rand.NewSource(1))
+		randomPos := func() aoi.Position {
+			return aoi.Position{X: float32(rnd.Intn(200) - 100), Y: float32(rnd.Intn(200) - 100), Z: float32(rnd.Intn(10))}
+		}
+		for i := 0; i < 2000; i++ {
+			id := int64(rnd.Intn(30) + 1)
+			switch e := scene.GetEntity(id); {
+			case e == nil:
+				scene.Enter(id, randomPos(), nil)
+			case rnd.Intn(5) == 0:
+				scene.Leave(id)
+			default:
+				scene.Move(id, randomPos())
+			}
+			if config.DeferReclaim && i%300 == 0 {
+				scene.Sweep()
+			}
+
+			empty := 0
+			for gridId, grid := range scene.GridCache {
+				if len(grid.EntityCache) == 0 {
+					empty++
+				}
+				for entityId, e := range grid.EntityCache {
+					if e.GridId != gridId || scene.EntityMap[entityId] != e {
+						t.Fatalf("step %d: entity %d in wrong cell", i, entityId)
+					}
+				}
+			}
+			if stats := scene.Stats(); stats.EmptyCells != empty || !config.DeferReclaim && empty != 0 {
+				t.Fatalf("step %d: %d empty cells, stats %+v", i, empty, stats)
+			}
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package grid
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+
+	"game-toolkit/aoi"
+)
+
+// 多个goroutine同时移动Entity，Listener里还会反过来移动其他Entity，需要配合-race运行
+func TestConcurrentMove(t *testing.T) {
+	const (
+		workers  = 8
+		perGroup = 20
+		rounds   = 200
+	)
+	scene := NewScene(Config{ViewDistance: 25, ViewShape: ViewCircle})
+
+	// 收到enter事件时把对方往旁边推一下，验证Listener里回调场景不会死锁
+	pusher := aoi.ListenerFunc(func(ev aoi.Event) {
+		if ev.Type != aoi.EventEnter || ev.TargetId%7 != 0 {
+			return
+		}
+		_ = scene.Move(ev.TargetId, aoi.Position{X: ev.Position.X + 1, Y: ev.Position.Y})
+	})
+
+	for id := int64(1); id <= workers*perGroup; id++ {
+		if err := scene.Enter(id, aoi.Position{X: float32(rand.Intn(200)), Y: float32(rand.Intn(200))}, pusher); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(w)))
+			for i := 0; i < rounds; i++ {
+				id := int64(w*perGroup + rnd.Intn(perGroup) + 1)
+				switch rnd.Intn(10) {
+				case 0:
+					_ = scene.Leave(id)
+				case 1:
+					_ = scene.Enter(id, aoi.Position{X: float32(rnd.Intn(200)), Y: float32(rnd.Intn(200))}, pusher)
+				default:
+					_ = scene.Move(id, aoi.Position{X: float32(rnd.Intn(200)), Y: float32(rnd.Intn(200))})
+				}
+				scene.Visible(id)
+				scene.QueryRadius(aoi.Position{X: float32(rnd.Intn(200)), Y: float32(rnd.Intn(200))}, 30)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	checkConsistency(t, scene)
+}
+
+// 可见集合需要和按定义逐对计算的结果一致，且watching和watchedBy互为镜像
+func checkConsistency(t *testing.T, scene *Scene) {
+	t.Helper()
+	scene.Lock()
+	defer scene.Unlock()
+	for id, e := range scene.EntityMap {
+		for otherId, other := range scene.EntityMap {
+			_, watching := e.watching[otherId]
+			if watching != scene.canSee(e, other, watching) {
+				t.Fatalf("%d watching %d is %v, expect %v", id, otherId, watching, !watching)
+			}
+			_, watchedBy := other.watchedBy[id]
+			if watching != watchedBy {
+				t.Fatalf("%d watching %d is %v, but watchedBy is %v", id, otherId, watching, watchedBy)
+			}
+		}
+	}
+}
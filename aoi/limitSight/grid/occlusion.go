@@ -0,0 +1,76 @@
+package grid
+
+import "game-toolkit/aoi"
+
+/*
+	[思路]
+	遮挡物的增删和开关由aoi.SceneOccluders处理，场景只负责找出需要重新计算的Entity
+	遮挡物变化后，连线可能穿过它的Entity对的两端离它都不超过视野能覆盖的最远距离，
+	只需要重新计算这个范围内的Entity，每个Entity的refresh同时处理它看别人和别人看它两个方向
+*/
+
+var _ aoi.OcclusionScene = (*Scene)(nil)
+
+func (s *Scene) AddOccluder(id int, seg aoi.Segment) {
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	s.occluders.Add(id, seg)
+}
+
+func (s *Scene) RemoveOccluder(id int) error {
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	return s.occluders.Remove(id)
+}
+
+func (s *Scene) SetOccluderEnabled(id int, enabled bool) error {
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	return s.occluders.SetEnabled(id, enabled)
+}
+
+// 以下方法均需要持锁调用
+
+// 重新计算离segs不超过视野最远距离的Entity的可见关系
+func (s *Scene) refreshNear(segs ...aoi.Segment) {
+	radius := s.config.RadiusX
+	if s.config.RadiusY > radius {
+		radius = s.config.RadiusY
+	}
+	reach := float32((radius+1)*s.config.GridSize) + s.config.Hysteresis
+	affected := make(map[int64]*Entity)
+	for _, seg := range segs {
+		check := func(e *Entity) {
+			if seg.Near(e.position(), reach) {
+				affected[e.Id] = e
+			}
+		}
+		if s.config.is3D() {
+			// 遮挡物不区分楼层，3D场景直接遍历所有Entity
+			for _, e := range s.EntityMap {
+				check(e)
+			}
+			continue
+		}
+		min := aoi.Position{X: minf(seg.A.X, seg.B.X) - reach, Y: minf(seg.A.Y, seg.B.Y) - reach}
+		max := aoi.Position{X: maxf(seg.A.X, seg.B.X) + reach, Y: maxf(seg.A.Y, seg.B.Y) + reach}
+		s.rangeEntities(min, max, check)
+	}
+	for _, e := range affected {
+		s.refresh(e, s.getRelatedEntities(e), false)
+	}
+}
+
+func minf(a, b float32) float32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxf(a, b float32) float32 {
+	if a > b {
+		return a
+	}
+	return b
+}
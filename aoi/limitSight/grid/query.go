@@ -0,0 +1,216 @@
+package grid
+
+import (
+	"sort"
+
+	"game-toolkit/aoi"
+)
+
+/*
+	[思路]
+	技能、掉落等逻辑需要的范围查询，先根据查询范围算出相交的格子，只遍历这些格子里的Entity，
+	再按精确距离过滤。查询不会产生任何AOI事件，也不会改变任何Entity的视野
+	3D场景下QueryRadius是球体、QueryRect是长方体，2D场景忽略Z坐标
+	查询期间持有场景锁，QueryNearest的match回调里不能再调用场景的方法
+*/
+
+var _ aoi.RangeQuerier = (*Scene)(nil)
+
+// QueryRadius 查询圆(球)内(含边界)的Entity
+func (s *Scene) QueryRadius(center aoi.Position, radius float32) (result []int64) {
+	if radius < 0 {
+		return
+	}
+	min := aoi.Position{X: center.X - radius, Y: center.Y - radius, Z: center.Z - radius}
+	max := aoi.Position{X: center.X + radius, Y: center.Y + radius, Z: center.Z + radius}
+	r2 := float64(radius) * float64(radius)
+	s.Lock()
+	defer s.Unlock()
+	s.rangeEntities(min, max, func(e *Entity) {
+		if s.distance2(center, e.position()) <= r2 {
+			result = append(result, e.Id)
+		}
+	})
+	return
+}
+
+// QueryRect 查询矩形(长方体)内(含边界)的Entity
+func (s *Scene) QueryRect(min, max aoi.Position) (result []int64) {
+	is3D := s.config.is3D()
+	if min.X > max.X || min.Y > max.Y || is3D && min.Z > max.Z {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.rangeEntities(min, max, func(e *Entity) {
+		if e.PositionX < min.X || e.PositionX > max.X || e.PositionY < min.Y || e.PositionY > max.Y {
+			return
+		}
+		if is3D && (e.PositionZ < min.Z || e.PositionZ > max.Z) {
+			return
+		}
+		result = append(result, e.Id)
+	})
+	return
+}
+
+// QueryNearest 查询离center最近的n个满足match的Entity，按距离由近到远排序，match为nil时不过滤
+// 从center所在的格子开始一圈一圈往外找，找够n个且下一圈不可能更近时停止
+func (s *Scene) QueryNearest(center aoi.Position, n int, match func(e *Entity) bool) (result []int64) {
+	if n <= 0 {
+		return
+	}
+	type candidate struct {
+		id        int64
+		distance2 float64
+	}
+	var candidates []candidate
+	collect := func(e *Entity) {
+		if match == nil || match(e) {
+			candidates = append(candidates, candidate{e.Id, s.distance2(center, e.position())})
+		}
+	}
+	sortCandidates := func() {
+		sort.Slice(candidates, func(i, j int) bool {
+			if candidates[i].distance2 != candidates[j].distance2 {
+				return candidates[i].distance2 < candidates[j].distance2
+			}
+			return candidates[i].id < candidates[j].id
+		})
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	gridCount, entityCount := len(s.GridCache), len(s.EntityMap)
+
+	// 3D场景下每一圈往外至少扩大格子边长和层高中较小的那个
+	size := s.config.GridSize
+	if s.config.is3D() && s.config.FloorHeight < size {
+		size = s.config.FloorHeight
+	}
+	cx, cy, cz := calculateBYByGridId(s.calculateGridId(center))
+	visited := 0
+	for ring := 0; visited < entityCount; ring++ {
+		// 圈数太大时逐格扫描不划算，直接遍历所有Entity
+		cells := (2*ring + 1) * (2*ring + 1)
+		if s.config.is3D() {
+			cells *= 2*ring + 1
+		}
+		if cells > gridCount {
+			candidates = candidates[:0]
+			for _, e := range s.EntityMap {
+				collect(e)
+			}
+			break
+		}
+		for _, grid := range s.getGridsByIds(s.ringGridIds(cx, cy, cz, ring)) {
+			for _, e := range grid.EntityCache {
+				visited++
+				collect(e)
+			}
+		}
+		// 第ring圈之外的Entity距离center至少为ring*size
+		if len(candidates) >= n {
+			sortCandidates()
+			if limit := float64(ring * size); candidates[n-1].distance2 <= limit*limit {
+				break
+			}
+		}
+	}
+
+	sortCandidates()
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+	for _, c := range candidates {
+		result = append(result, c.id)
+	}
+	return
+}
+
+// 遍历与矩形(长方体)相交的格子里的Entity，需要持锁调用
+func (s *Scene) rangeEntities(min, max aoi.Position, f func(e *Entity)) {
+	minX, minY, minZ := calculateBYByGridId(s.calculateGridId(min))
+	maxX, maxY, maxZ := calculateBYByGridId(s.calculateGridId(max))
+	if s.config.bounded() {
+		minX, maxX = clamp(minX, 0, s.maxXIndex), clamp(maxX, 0, s.maxXIndex)
+		minY, maxY = clamp(minY, 0, s.maxYIndex), clamp(maxY, 0, s.maxYIndex)
+	}
+
+	var grids []*Grid
+	// 查询范围比已有的格子还多时，直接遍历已有的格子
+	if moreCellsThan(len(s.GridCache), maxX-minX+1, maxY-minY+1, maxZ-minZ+1) {
+		for gridId, grid := range s.GridCache {
+			x, y, z := calculateBYByGridId(gridId)
+			if x >= minX && x <= maxX && y >= minY && y <= maxY && z >= minZ && z <= maxZ {
+				grids = append(grids, grid)
+			}
+		}
+	} else {
+		for x := minX; x <= maxX; x++ {
+			for y := minY; y <= maxY; y++ {
+				for z := minZ; z <= maxZ; z++ {
+					if grid, ok := s.GridCache[calculateGridIdByXYZ(x, y, z)]; ok {
+						grids = append(grids, grid)
+					}
+				}
+			}
+		}
+	}
+
+	for _, grid := range grids {
+		for _, e := range grid.EntityCache {
+			f(e)
+		}
+	}
+}
+
+// 以(x, y, z)为中心的第ring圈格子，3D场景下是一层立方体的外壳
+func (s *Scene) ringGridIds(x, y, z, ring int) (gridIds []uint64) {
+	// 超出下标范围的格子里不会有Entity，直接跳过
+	add := func(i, j, k int) {
+		if validCell(i, j, k) {
+			gridIds = append(gridIds, calculateGridIdByXYZ(i, j, k))
+		}
+	}
+	if ring == 0 {
+		add(x, y, z)
+		return
+	}
+	minZ, maxZ := z, z
+	if s.config.is3D() {
+		minZ, maxZ = z-ring, z+ring
+	}
+	for k := minZ; k <= maxZ; k++ {
+		// 上下两个面是整个正方形，中间的层只有一圈
+		if k == z-ring || k == z+ring {
+			for i := x - ring; i <= x+ring; i++ {
+				for j := y - ring; j <= y+ring; j++ {
+					add(i, j, k)
+				}
+			}
+			continue
+		}
+		for i := x - ring; i <= x+ring; i++ {
+			add(i, y-ring, k)
+			add(i, y+ring, k)
+		}
+		for j := y - ring + 1; j <= y+ring-1; j++ {
+			add(x-ring, j, k)
+			add(x+ring, j, k)
+		}
+	}
+	return
+}
+
+// 各个维度的格子数相乘是否超过limit，超过之后立即返回，超大的3D查询范围直接相乘会溢出
+func moreCellsThan(limit int, spans ...int) bool {
+	n := 1
+	for _, span := range spans {
+		n *= span
+		if n > limit {
+			return true
+		}
+	}
+	return false
+}
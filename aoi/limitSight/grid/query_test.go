@@ -0,0 +1,112 @@
+package grid
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+
+	"game-toolkit/aoi"
+)
+
+func TestQuery(t *testing.T) {
+	scene := NewScene(Config{})
+	positions := make(map[int64]aoi.Position)
+	rnd := rand.New(rand.NewSource(1))
+	for id := int64(1); id <= 300; id++ {
+		pos := aoi.Position{X: float32(rnd.Intn(1600)-800) / 4, Y: float32(rnd.Intn(1600)-800) / 4}
+		positions[id] = pos
+		if err := scene.Enter(id, pos, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 50; i++ {
+		center := aoi.Position{X: float32(rnd.Intn(1600)-800) / 4, Y: float32(rnd.Intn(1600)-800) / 4}
+		radius := float32(rnd.Intn(240)) / 4
+
+		var expect []int64
+		for id, pos := range positions {
+			if scene.distance2(center, pos) <= float64(radius)*float64(radius) {
+				expect = append(expect, id)
+			}
+		}
+		assertIds(t, "radius", scene.QueryRadius(center, radius), expect)
+
+		min := aoi.Position{X: center.X - radius, Y: center.Y - radius/2}
+		max := aoi.Position{X: center.X + radius/2, Y: center.Y + radius}
+		expect = expect[:0]
+		for id, pos := range positions {
+			if pos.X >= min.X && pos.X <= max.X && pos.Y >= min.Y && pos.Y <= max.Y {
+				expect = append(expect, id)
+			}
+		}
+		assertIds(t, "rect", scene.QueryRect(min, max), expect)
+
+		// 只找id为偶数的
+		n := rnd.Intn(10) + 1
+		var all []int64
+		for id := range positions {
+			if id%2 == 0 {
+				all = append(all, id)
+			}
+		}
+		sort.Slice(all, func(i, j int) bool {
+			di, dj := scene.distance2(center, positions[all[i]]), scene.distance2(center, positions[all[j]])
+			if di != dj {
+				return di < dj
+			}
+			return all[i] < all[j]
+		})
+		got := scene.QueryNearest(center, n, func(e *Entity) bool { return e.Id%2 == 0 })
+		if !sameIds(got, all[:n]) {
+			t.Fatalf("nearest %d of %+v: got %v, expect %v", n, center, got, all[:n])
+		}
+	}
+
+	if got := scene.QueryNearest(aoi.Position{}, 1000, nil); len(got) != len(positions) {
+		t.Fatalf("nearest should return all %d entities, got %d", len(positions), len(got))
+	}
+
+	// 查询不应该触发任何事件
+	r := &recorder{}
+	_ = scene.Enter(1000, aoi.Position{}, r)
+	count := len(r.events)
+	scene.QueryRadius(aoi.Position{}, 100)
+	scene.QueryRect(aoi.Position{X: -100, Y: -100}, aoi.Position{X: 100, Y: 100})
+	scene.QueryNearest(aoi.Position{}, 10, nil)
+	if len(r.events) != count {
+		t.Fatalf("query should not fire events")
+	}
+}
+
+// 查询范围覆盖的格子数超过int的范围时，退化成遍历已有的格子，不能逐格扫描
+func TestQueryHugeBox(t *testing.T) {
+	scene := NewScene(Config{FloorHeight: 10})
+	expect := []int64{1, 2, 3}
+	scene.Enter(1, aoi.Position{X: -5000, Y: 300, Z: -40}, nil)
+	scene.Enter(2, aoi.Position{}, nil)
+	scene.Enter(3, aoi.Position{X: 7000, Y: -8000, Z: 120}, nil)
+	assertIds(t, "huge rect", scene.QueryRect(aoi.Position{X: -1e9, Y: -1e9, Z: -1e9}, aoi.Position{X: 1e9, Y: 1e9, Z: 1e9}), expect)
+	assertIds(t, "huge radius", scene.QueryRadius(aoi.Position{}, 1e9), expect)
+}
+
+func assertIds(t *testing.T, name string, got, expect []int64) {
+	t.Helper()
+	sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+	sort.Slice(expect, func(i, j int) bool { return expect[i] < expect[j] })
+	if !sameIds(got, expect) {
+		t.Fatalf("%s query: got %v, expect %v", name, got, expect)
+	}
+}
+
+func sameIds(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -1,87 +1,384 @@
 package grid
 
 import (
-	"fmt"
+	"math"
 	"sync"
 	"sync/atomic"
+
+	"game-toolkit/aoi"
 )
 
 /*
 	[思路]
 	九宫格AOI算法以自身所在格子为中心，其周围的八个格子为包围圈，总共九个格子。
-	当玩家从自身所在的格子移动到其他格子时，重新计算新的九宫格。
-	向离开的格子内的Entity发送leave sight命令，向进入的格子内的Entity发送enter sight
-
-	[缺点]
-	无法把想要的视野范围设置的很大，如果设置的视野范围超过了九宫格的范围，那将毫无意义。
-	所以如果采用这种设计，客户端表现上的视野范围要小于等于九宫格的范围
+	格子只用来缩小查找范围：进场、移动时只需要检查视野格子内的Entity，
+	再按精确的视野距离判断谁能看到谁。每个Entity都维护自己的watching(我能看到谁)和watchedBy(谁能看到我)，
+	enter/leave事件由新旧两个集合求差得到，而不是由格子的进出决定
+
+	[视野]
+	格子边长和视野半径(以格子数计)由场景配置决定，半径为1即九宫格，半径为2即5x5，
+	X和Y方向的半径可以不同(比如宽屏需要横向看得更远)。
+	配置了ViewDistance时，视野格子内的Entity还需要满足圆形或正方形的精确距离，
+	此时视野半径会自动扩大到能完整覆盖ViewDistance
+
+	[防抖]
+	Entity在格子边界或者视野距离边界上来回移动时，观察者会不停地收到enter/leave。配置了Hysteresis之后，
+	进入视野的条件不变，已经能看到的Entity要离开得更远才会leave: 配置了ViewDistance时离开距离是ViewDistance+Hysteresis，
+	否则是视野格子能覆盖的最远距离(Radius+1)*GridSize再加上Hysteresis。来回移动的幅度小于Hysteresis时不会再反复触发事件。
+	楼层之间不做防抖，换了楼层就按RadiusZ严格判断
+
+	[可见性]
+	几何上能看到之后，还要满足watcher和target的aoi.Visibility掩码以及场景配置的Filter，
+	用于隐身GM、潜行、队伍可见的NPC、任务相位等。掩码或Filter依赖的状态变化后，通过SetVisibility/Refresh重新计算
+
+	[场景]
+	每个Scene独立持有自己的格子缓存、Entity注册表以及配置，副本、分线等可以各自创建Scene，互不影响。
+	Entity通过Scene.NewEntity创建，之后的EnterMap/LeaveMap/ChangePosition都会路由到其所属的Scene
+
+	[并发]
+	一个Scene只有一把锁，格子、Entity的位置和可见集合都由这把锁保护，不存在多把锁之间的加锁顺序问题。
+	对外的方法在持锁期间只计算可见性的变化，把要发送的事件暂存起来，释放锁之后再回调Listener，
+	所以Listener里可以再调用场景的任何方法(比如让另一个Entity移动)而不会死锁。
+	同一次调用产生的事件按顺序投递；多个goroutine并发调用时，Listener可能被并发回调，需要自己保证并发安全
+
+	[批量]
+	配置了Batch时，事件不会立即投递，而是按Watcher缓存到帧末，由Flush合并后一次性投递，见aoi.EventBuffer
+
+	[地图]
+	默认地图无限大，坐标可以为负，格子下标按向下取整计算，所以-1落在-1号格子而不是0号格子。
+	坐标是float32，格子下标先转成float64再相除取整，刚好落在格子边界上的Entity属于右边(上边)的格子，
+	比如格子边长为10时，9.999落在0号格子，10落在1号格子，-10落在-1号格子，结果和平台无关
+	配置了边界的地图，格子下标以(MinX, MinY)为原点，视野格子在地图边缘会被截断，
+	进入或移动到边界外会返回aoi.ErrOutOfBounds。格子ID里X、Y下标各占24位，层下标占16位，
+	无限大的地图上超出这个范围的位置同样返回aoi.ErrOutOfBounds，而不是绕回到另一头的格子
+
+	[3D]
+	配置了FloorHeight时场景是三维的，Z轴按FloorHeight分层，每层各自有一套格子，
+	只有相差不超过RadiusZ层的Entity才可能互相看到，默认RadiusZ为0，即不同楼层互相看不到。
+	飞行坐骑这类Z轴连续的地图，把FloorHeight设成和格子边长差不多，再配置RadiusZ即可。
+	ViewDistance在3D场景下按三维距离计算，但不会自动扩大RadiusZ，楼层之间是否可见只由RadiusZ决定
 */
 
-const gridSize = 10 // 给定格子边长
+const (
+	defaultGridSize     = 10  // 默认格子边长
+	defaultRadius       = 1   // 默认视野半径，即九宫格
+	defaultCellPoolSize = 256 // 默认最多缓存的空格子数量
+)
 
-// 这里先假定地图无限大
+const (
+	ViewSquare = iota // 正方形视野，|dx|和|dy|都不超过ViewDistance
+	ViewCircle        // 圆形视野，dx^2+dy^2不超过ViewDistance^2
+)
 
 var EntityIdGen int64
-var GridManager *gridManager
 
-func init() {
-	GridManager = &gridManager{
-		GridCache: make(map[uint64]*Grid),
+type Config struct {
+	GridSize int // 格子边长，<=0时使用defaultGridSize
+	RadiusX  int // X方向的视野半径(格子数)，<=0时使用defaultRadius
+	RadiusY  int // Y方向的视野半径(格子数)，<=0时使用defaultRadius
+
+	FloorHeight int // Z轴每层的高度，<=0时为2D场景，忽略Z坐标
+	RadiusZ     int // 上下能看到的层数，<=0时只能看到同一层
+
+	ViewDistance float32 // 精确的视野距离，<=0时不做距离过滤，视野格子内的Entity均可见
+	ViewShape    int     // ViewSquare or ViewCircle
+	Hysteresis   float32 // 防抖距离，已经能看到的Entity要再远这么多才会离开视野，<=0时不防抖
+
+	Batch bool // 是否开启批量模式，开启后需要每帧调用Flush
+
+	Filter aoi.Filter // 额外的可见性判断，为nil时不过滤
+
+	DeferReclaim bool // 空格子不立即回收，由调用方定期调用Sweep，适合Entity在格子边界上频繁进出的场景
+	CellPoolSize int  // 回收之后缓存起来复用的格子数量上限，<=0时使用defaultCellPoolSize
+
+	// 地图边界(闭区间)，全为0时表示地图无限大
+	MinX float32
+	MinY float32
+	MaxX float32
+	MaxY float32
+}
+
+func (c Config) is3D() bool {
+	return c.FloorHeight > 0
+}
+
+func (c Config) bounded() bool {
+	return c.MinX != 0 || c.MinY != 0 || c.MaxX != 0 || c.MaxY != 0
+}
+
+func (c Config) contains(x, y float32) bool {
+	if !c.bounded() {
+		return true
 	}
+	return x >= c.MinX && x <= c.MaxX && y >= c.MinY && y <= c.MaxY
 }
 
-type gridManager struct {
+type Scene struct {
 	sync.Mutex
-	GridCache map[uint64]*Grid
+	config     Config
+	maxXIndex  int // 有边界时格子下标的最大值
+	maxYIndex  int
+	GridCache  map[uint64]*Grid
+	EntityMap  map[int64]*Entity  // 当前在场景内的Entity
+	buffer     *aoi.EventBuffer   // 批量模式下缓存的事件
+	dispatcher aoi.Dispatcher     // 当前这次调用产生的事件，释放锁之后再投递
+	silent     bool               // 静默恢复快照时不发送任何事件
+	occluders  aoi.SceneOccluders // 遮挡物
+	cells      cellPool           // 空格子的回收和复用
 }
 
-const (
-	TypeEnterMap = iota
-	TypeEnterSight
-	TypeChangePosition
-	TypeLeaveSight
-	TypeLeaveMap
-	TypeSync // 自身的探测，我移动之后能看见谁
+var (
+	_ aoi.Scene           = (*Scene)(nil)
+	_ aoi.Flusher         = (*Scene)(nil)
+	_ aoi.VisibilityScene = (*Scene)(nil)
 )
 
-func (g *gridManager) SetEntityInGrid(entity *Entity) {
-	if entity == nil {
-		return
+func NewScene(config Config) *Scene {
+	if config.GridSize <= 0 {
+		config.GridSize = defaultGridSize
+	}
+	if config.RadiusX <= 0 {
+		config.RadiusX = defaultRadius
+	}
+	if config.RadiusY <= 0 {
+		config.RadiusY = defaultRadius
+	}
+	if config.CellPoolSize <= 0 {
+		config.CellPoolSize = defaultCellPoolSize
+	}
+	if !config.is3D() || config.RadiusZ < 0 {
+		config.RadiusZ = 0
+	}
+	if config.ViewDistance > 0 {
+		// 视野格子要能完整覆盖视野距离
+		radius := int(math.Ceil(float64(config.ViewDistance) / float64(config.GridSize)))
+		if config.RadiusX < radius {
+			config.RadiusX = radius
+		}
+		if config.RadiusY < radius {
+			config.RadiusY = radius
+		}
+	}
+	s := &Scene{
+		config:    config,
+		GridCache: make(map[uint64]*Grid),
+		EntityMap: make(map[int64]*Entity),
+	}
+	s.occluders = aoi.NewSceneOccluders(float32(config.GridSize), s.refreshNear)
+	if config.Batch {
+		s.buffer = aoi.NewEventBuffer()
+	}
+	if config.bounded() {
+		s.maxXIndex = cellIndex(config.MaxX, config.MinX, config.GridSize)
+		s.maxYIndex = cellIndex(config.MaxY, config.MinY, config.GridSize)
+	}
+	return s
+}
+
+// NewEntity 创建一个归属于当前场景的Entity
+func (s *Scene) NewEntity() (e *Entity) {
+	return &Entity{
+		Id:         atomic.AddInt64(&EntityIdGen, 1),
+		scene:      s,
+		visibility: aoi.DefaultVisibility,
+	}
+}
+
+// Close 销毁场景，清空格子和Entity，不再发送任何消息
+func (s *Scene) Close() {
+	s.Lock()
+	defer s.Unlock()
+	for _, e := range s.EntityMap {
+		e.inMap = false
+		e.watching, e.watchedBy = nil, nil
+	}
+	s.GridCache = make(map[uint64]*Grid)
+	s.EntityMap = make(map[int64]*Entity)
+	s.cells.reset()
+	if s.buffer != nil {
+		s.buffer.Drain()
+	}
+}
+
+// Enter 实现aoi.Scene，以指定id创建Entity并进入场景
+func (s *Scene) Enter(id int64, pos aoi.Position, listener aoi.Listener) error {
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	if err := s.enter(&Entity{Id: id, Listener: listener, scene: s, visibility: aoi.DefaultVisibility}, pos); err != nil {
+		return err
 	}
-	gridId := entity.GridId
-	g.Lock()
-	grid, ok := g.GridCache[gridId]
+	// 之后NewEntity生成的id不能和它重复
+	aoi.ReserveId(&EntityIdGen, id)
+	return nil
+}
+
+func (s *Scene) Leave(id int64) error {
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	e, ok := s.EntityMap[id]
 	if !ok {
-		grid = &Grid{EntityCache: make(map[int64]*Entity)}
-		g.GridCache[gridId] = grid
+		return aoi.ErrEntityNotFound
 	}
-	g.Unlock()
+	s.leave(e)
+	return nil
+}
 
-	grid.Lock()
-	grid.EntityCache[entity.Id] = entity
-	grid.Unlock()
+func (s *Scene) Move(id int64, pos aoi.Position) error {
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	e, ok := s.EntityMap[id]
+	if !ok {
+		return aoi.ErrEntityNotFound
+	}
+	return s.move(e, pos)
 }
 
-func (g *gridManager) RemoveEntityFromGrid(entity *Entity) {
-	if entity == nil {
-		return
+func (s *Scene) SetVisibility(id int64, v aoi.Visibility) error {
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	e, ok := s.EntityMap[id]
+	if !ok {
+		return aoi.ErrEntityNotFound
+	}
+	e.visibility = v
+	s.refresh(e, s.getRelatedEntities(e), false)
+	return nil
+}
+
+func (s *Scene) Refresh(id int64) error {
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	e, ok := s.EntityMap[id]
+	if !ok {
+		return aoi.ErrEntityNotFound
 	}
-	gridId := entity.GridId
-	g.Lock()
-	grid, ok := g.GridCache[gridId]
-	g.Unlock()
+	s.refresh(e, s.getRelatedEntities(e), false)
+	return nil
+}
+
+// Visible 获取id当前能看到的Entity
+func (s *Scene) Visible(id int64) (result []int64) {
+	s.Lock()
+	defer s.Unlock()
+	e, ok := s.EntityMap[id]
 	if !ok {
 		return
 	}
+	for otherId := range e.watching {
+		result = append(result, otherId)
+	}
+	return
+}
 
-	grid.RemoveEntity(entity)
+func (s *Scene) GetEntity(id int64) *Entity {
+	s.Lock()
+	defer s.Unlock()
+	return s.EntityMap[id]
+}
+
+// Flush 批量模式下把本帧缓存的事件合并后投递给各个Watcher，已经离开场景的Watcher不再投递
+func (s *Scene) Flush() {
+	if s.buffer == nil {
+		return
+	}
+	aoi.FlushBuffer(s, s.buffer, func(watcherId int64) aoi.Listener {
+		if e, ok := s.EntityMap[watcherId]; ok {
+			return e.Listener
+		}
+		return nil
+	})
 }
 
-func (g *gridManager) GetGridsByIds(gridIds []uint64) (result []*Grid) {
-	g.Lock()
-	defer g.Unlock()
+// EntityCount 当前场景内的Entity数量
+func (s *Scene) EntityCount() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.EntityMap)
+}
+
+// 需要持锁调用
+func (s *Scene) emit(watcher *Entity, ev aoi.Event) {
+	if s.silent {
+		return
+	}
+	if s.buffer != nil {
+		s.buffer.Add(ev)
+		return
+	}
+	s.dispatcher.Add(watcher.Listener, ev)
+}
+
+// 以下方法均需要持锁调用
+
+func (s *Scene) enter(e *Entity, pos aoi.Position) error {
+	if _, ok := s.EntityMap[e.Id]; ok || e.inMap {
+		return aoi.ErrEntityExists
+	}
+	if !s.config.contains(pos.X, pos.Y) || !validCell(s.cellIndexes(pos)) {
+		return aoi.ErrOutOfBounds
+	}
+	// 1. 根据x & y & z算出gridId
+	e.PositionX, e.PositionY, e.PositionZ = pos.X, pos.Y, pos.Z
+	e.GridId = s.calculateGridId(pos)
+	e.inMap = true
+	e.watching = make(map[int64]*Entity)
+	e.watchedBy = make(map[int64]*Entity)
+	s.setEntityInGrid(e)
+
+	// 2. 和视野格子内的Entity互相检查可见性
+	s.refresh(e, s.getSightEntities(e), false)
+	return nil
+}
+
+func (s *Scene) leave(e *Entity) {
+	s.removeEntityFromGrid(e)
+	for _, other := range e.watchedBy {
+		delete(other.watching, e.Id)
+		s.emit(other, aoi.Event{Type: aoi.EventLeave, WatcherId: other.Id, TargetId: e.Id, Position: e.position()})
+	}
+	for _, other := range e.watching {
+		delete(other.watchedBy, e.Id)
+	}
+	e.watching, e.watchedBy = nil, nil
+	e.inMap = false
+}
+
+func (s *Scene) move(e *Entity, pos aoi.Position) error {
+	if !s.config.contains(pos.X, pos.Y) || !validCell(s.cellIndexes(pos)) {
+		return aoi.ErrOutOfBounds
+	}
+	originGridId := e.GridId
+	e.PositionX, e.PositionY, e.PositionZ = pos.X, pos.Y, pos.Z
+	e.GridId = s.calculateGridId(pos)
+	if e.GridId != originGridId {
+		s.removeFromCell(originGridId, e.Id)
+		s.setEntityInGrid(e)
+	}
+
+	s.refresh(e, s.getRelatedEntities(e), true)
+	return nil
+}
+
+func (s *Scene) setEntityInGrid(entity *Entity) {
+	grid, ok := s.GridCache[entity.GridId]
+	if !ok {
+		grid = s.cells.get()
+		s.GridCache[entity.GridId] = grid
+	} else if len(grid.EntityCache) == 0 {
+		s.cells.empty--
+	}
+	grid.EntityCache[entity.Id] = entity
+	s.EntityMap[entity.Id] = entity
+}
+
+func (s *Scene) removeEntityFromGrid(entity *Entity) {
+	delete(s.EntityMap, entity.Id)
+	s.removeFromCell(entity.GridId, entity.Id)
+}
+
+func (s *Scene) getGridsByIds(gridIds []uint64) (result []*Grid) {
 	for _, gridId := range gridIds {
-		grid, ok := g.GridCache[gridId]
+		grid, ok := s.GridCache[gridId]
 		if !ok {
 			continue
 		}
@@ -90,174 +387,331 @@ func (g *gridManager) GetGridsByIds(gridIds []uint64) (result []*Grid) {
 	return
 }
 
-func (g *gridManager) GetGridsById(gridId uint64) (result *Grid) {
-	g.Lock()
-	defer g.Unlock()
-	result = g.GridCache[gridId]
+// 根据位置计算格子ID，有边界时以(MinX, MinY)为原点，2D场景的层下标都是0
+// 超出下标范围的位置(只有范围查询会传进来)截断到最边上的格子
+func (s *Scene) calculateGridId(pos aoi.Position) uint64 {
+	x, y, z := s.cellIndexes(pos)
+	return calculateGridIdByXYZ(clamp(x, minCellIndex, maxCellIndex), clamp(y, minCellIndex, maxCellIndex), clamp(z, minFloorIndex, maxFloorIndex))
+}
+
+// 位置所在格子的下标，没有检查范围
+func (s *Scene) cellIndexes(pos aoi.Position) (x, y, z int) {
+	size := s.config.GridSize
+	return cellIndex(pos.X, s.config.MinX, size), cellIndex(pos.Y, s.config.MinY, size), s.floor(pos.Z)
+}
+
+func (s *Scene) floor(z float32) int {
+	if !s.config.is3D() {
+		return 0
+	}
+	return cellIndex(z, 0, s.config.FloorHeight)
+}
+
+// 视野格子内的其他Entity，是进场和移动时需要检查的候选集合
+func (s *Scene) getSightEntities(e *Entity) (result map[int64]*Entity) {
+	result = make(map[int64]*Entity)
+	for _, grid := range s.getGridsByIds(s.getSightGridIds(e.GridId)) {
+		for id, other := range grid.EntityCache {
+			if id != e.Id {
+				result[id] = other
+			}
+		}
+	}
 	return
 }
 
-type Grid struct {
-	sync.Mutex
-	EntityCache map[int64]*Entity
+// 需要重新检查可见关系的候选集合: 视野格子内的Entity + 之前互相可见的Entity(可能已经不在视野格子内了)
+func (s *Scene) getRelatedEntities(e *Entity) (result map[int64]*Entity) {
+	result = s.getSightEntities(e)
+	for id, other := range e.watching {
+		result[id] = other
+	}
+	for id, other := range e.watchedBy {
+		result[id] = other
+	}
+	return
 }
 
-func (g *Grid) DoAction(entity *Entity, category int) {
-	g.Lock()
-	for id, e := range g.EntityCache {
-		if id == entity.Id {
-			continue
+// watcher能否看到target: 先在视野格子内，再满足精确的视野距离，然后视线不被遮挡，最后是可见性掩码和Filter
+// watching表示watcher当前已经能看到target，开启防抖时按离开的距离判断，视线被挡住时不防抖
+func (s *Scene) canSee(watcher, target *Entity, watching bool) bool {
+	if watcher == target || !watcher.visibility.CanSee(target.visibility) {
+		return false
+	}
+	if watching && s.config.Hysteresis > 0 {
+		if !s.inLeaveRange(watcher, target) {
+			return false
 		}
-		var data any
-		switch category {
-		case TypeEnterMap:
-			data = "enter map"
-		case TypeEnterSight:
-			data = "enter sight"
-		case TypeChangePosition:
-			data = fmt.Sprintf("change position to x: %d, y: %d", entity.PositionX, entity.PositionY)
-		case TypeLeaveSight:
-			data = "leave sight"
-		case TypeLeaveMap:
-			data = "leave map"
-		case TypeSync:
-			data = fmt.Sprintf("sync, I can see %d on x: %d, y: %d", e.Id, e.PositionX, e.PositionY)
+	} else if !s.inSight(watcher, target) {
+		return false
+	}
+	if s.occluders.Blocked(watcher.position(), target.position()) {
+		return false
+	}
+	return s.config.Filter == nil || s.config.Filter(watcher.Id, target.Id)
+}
+
+// 纯几何上的判断
+func (s *Scene) inSight(watcher, target *Entity) bool {
+	wx, wy, wz := calculateBYByGridId(watcher.GridId)
+	tx, ty, tz := calculateBYByGridId(target.GridId)
+	if abs(wx-tx) > s.config.RadiusX || abs(wy-ty) > s.config.RadiusY || abs(wz-tz) > s.config.RadiusZ {
+		return false
+	}
+	if s.config.ViewDistance <= 0 {
+		return true
+	}
+	d := float64(s.config.ViewDistance)
+	if s.config.ViewShape == ViewCircle {
+		return s.distance2(watcher.position(), target.position()) <= d*d
+	}
+	dx := math.Abs(float64(watcher.PositionX) - float64(target.PositionX))
+	dy := math.Abs(float64(watcher.PositionY) - float64(target.PositionY))
+	dz := 0.0
+	if s.config.is3D() {
+		dz = math.Abs(float64(watcher.PositionZ) - float64(target.PositionZ))
+	}
+	return dx <= d && dy <= d && dz <= d
+}
+
+// 开启防抖时，已经能看到的target还在这个范围内就不会离开视野，这个范围一定包含了进入视野的范围
+func (s *Scene) inLeaveRange(watcher, target *Entity) bool {
+	_, _, wz := calculateBYByGridId(watcher.GridId)
+	_, _, tz := calculateBYByGridId(target.GridId)
+	if abs(wz-tz) > s.config.RadiusZ {
+		return false
+	}
+	delta := float64(s.config.Hysteresis)
+	if s.config.ViewDistance > 0 {
+		d := float64(s.config.ViewDistance) + delta
+		if s.config.ViewShape == ViewCircle {
+			return s.distance2(watcher.position(), target.position()) <= d*d
 		}
-		if category == TypeSync {
-			entity.ReceiveNews(e.Id, data)
-		} else {
-			e.ReceiveNews(entity.Id, data)
+		dx := math.Abs(float64(watcher.PositionX) - float64(target.PositionX))
+		dy := math.Abs(float64(watcher.PositionY) - float64(target.PositionY))
+		dz := 0.0
+		if s.config.is3D() {
+			dz = math.Abs(float64(watcher.PositionZ) - float64(target.PositionZ))
 		}
+		return dx <= d && dy <= d && dz <= d
 	}
-	g.Unlock()
+	// 视野格子内的Entity离watcher最远不到(Radius+1)*GridSize
+	size := float64(s.config.GridSize)
+	dx := math.Abs(float64(watcher.PositionX) - float64(target.PositionX))
+	dy := math.Abs(float64(watcher.PositionY) - float64(target.PositionY))
+	return dx < float64(s.config.RadiusX+1)*size+delta && dy < float64(s.config.RadiusY+1)*size+delta
 }
 
-func (g *Grid) RemoveEntity(entity *Entity) {
-	g.Lock()
-	delete(g.EntityCache, entity.Id)
-	g.Unlock()
+// 根据当前位置重新计算e和candidates之间的可见关系，按差集发送事件
+// moved表示e的位置发生了变化，需要通知一直能看到e的Entity
+func (s *Scene) refresh(e *Entity, candidates map[int64]*Entity, moved bool) {
+	for id, other := range candidates {
+		// 我能不能看到对方
+		_, was := e.watching[id]
+		now := s.canSee(e, other, was)
+		if now && !was {
+			e.watching[id] = other
+			other.watchedBy[e.Id] = e
+			s.emit(e, aoi.Event{Type: aoi.EventSync, WatcherId: e.Id, TargetId: id, Position: other.position()})
+		} else if !now && was {
+			delete(e.watching, id)
+			delete(other.watchedBy, e.Id)
+			s.emit(e, aoi.Event{Type: aoi.EventLeave, WatcherId: e.Id, TargetId: id, Position: other.position()})
+		}
+
+		// 对方能不能看到我
+		_, was = e.watchedBy[id]
+		now = s.canSee(other, e, was)
+		ev := aoi.Event{WatcherId: id, TargetId: e.Id, Position: e.position()}
+		switch {
+		case now && !was:
+			e.watchedBy[id] = other
+			other.watching[e.Id] = e
+			ev.Type = aoi.EventEnter
+		case !now && was:
+			delete(e.watchedBy, id)
+			delete(other.watching, e.Id)
+			ev.Type = aoi.EventLeave
+		case now && moved:
+			ev.Type = aoi.EventMove
+		default:
+			continue
+		}
+		s.emit(other, ev)
+	}
 }
 
+// Grid 格子本身不加锁，由所属Scene的锁保护
+type Grid struct {
+	EntityCache map[int64]*Entity
+}
+
+// Entity 的导出字段只能在持有场景锁时读写，并发场景下请通过Position等方法读取
 type Entity struct {
 	Id        int64
 	GridId    uint64
-	PositionX int
-	PositionY int
+	PositionX float32
+	PositionY float32
+	PositionZ float32
+
+	Listener aoi.Listener // 接收AOI事件，为nil时丢弃事件
+
+	scene      *Scene
+	inMap      bool
+	visibility aoi.Visibility
+	watching   map[int64]*Entity // 我能看到的Entity
+	watchedBy  map[int64]*Entity // 能看到我的Entity
 }
 
-func NewEntity() (e *Entity) {
-	return &Entity{
-		Id: atomic.AddInt64(&EntityIdGen, 1),
+// Scene 获取Entity所属的场景
+func (e *Entity) Scene() *Scene {
+	return e.scene
+}
+
+// Position 并发安全地获取当前位置
+func (e *Entity) Position() aoi.Position {
+	e.scene.Lock()
+	defer e.scene.Unlock()
+	return e.position()
+}
+
+// SetVisibility 修改可见性掩码，已经在场景内时会重新计算可见关系
+func (e *Entity) SetVisibility(v aoi.Visibility) {
+	s := e.scene
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	e.visibility = v
+	if e.inMap {
+		s.refresh(e, s.getRelatedEntities(e), false)
 	}
 }
 
-func (e *Entity) ReceiveNews(entityId int64, data any) {
-	fmt.Printf("%d received %d's message, data is %+v\n", e.Id, entityId, data)
+func (e *Entity) position() aoi.Position {
+	return aoi.Position{X: e.PositionX, Y: e.PositionY, Z: e.PositionZ}
 }
 
-func (e *Entity) EnterMap(x, y int) {
-	// 1. 根据x & y算出gridId
-	e.PositionX, e.PositionY = x, y
-	e.setGridId()
-	GridManager.SetEntityInGrid(e)
+func (e *Entity) EnterMap(x, y float32) error {
+	return e.EnterMap3D(x, y, 0)
+}
 
-	grids := GridManager.GetGridsByIds(getSightGridIds(e.GridId))
-	for _, grid := range grids {
-		grid.DoAction(e, TypeEnterMap)
-		grid.DoAction(e, TypeSync)
-	}
+func (e *Entity) EnterMap3D(x, y, z float32) error {
+	s := e.scene
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	return s.enter(e, aoi.Position{X: x, Y: y, Z: z})
 }
 
 func (e *Entity) LeaveMap() {
-	grids := GridManager.GetGridsByIds(getSightGridIds(e.GridId))
-	for _, grid := range grids {
-		grid.DoAction(e, TypeLeaveMap)
+	s := e.scene
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	if !e.inMap {
+		return
 	}
-	GridManager.RemoveEntityFromGrid(e)
+	s.leave(e)
 }
 
-func (e *Entity) ChangePosition(x, y int) {
-	originGridId := e.GridId
-	e.PositionX, e.PositionY = x, y
-	e.setGridId()
-	currentGridId := e.GridId
-	currentGridIds := getSightGridIds(e.GridId)
-	currentGrids := GridManager.GetGridsByIds(currentGridIds)
-
-	// 这里表示伴随着格子的切换，需要发送进/出的消息给对应的玩家
-	// origin从有到无发leave sight，current从无到有发enter sight
-	if currentGridId != originGridId {
-		oldGrid := GridManager.GetGridsById(originGridId)
-		oldGrid.RemoveEntity(e)
-
-		originGridIds := getSightGridIds(originGridId)
-		currentGridMap := changeSlice2Map(currentGridIds)
-		originGridMap := changeSlice2Map(originGridIds)
-
-		result := make(map[uint64]bool) // true表示enter, false表示leave
-		for id := range currentGridMap {
-			if _, ok := originGridMap[id]; !ok {
-				result[id] = true
-			}
-		}
-		for id := range originGridMap {
-			if _, ok := currentGridMap[id]; !ok {
-				result[id] = false
-			}
-		}
-		for id, v := range result {
-			grid := GridManager.GetGridsById(id)
-			if grid == nil {
-				continue
-			}
-			if v {
-				grid.DoAction(e, TypeEnterSight)
-				grid.DoAction(e, TypeSync)
-			} else {
-				grid.DoAction(e, TypeLeaveSight)
+// ChangePosition 在当前高度上平移，移动到边界外时拒绝本次移动，位置保持不变
+func (e *Entity) ChangePosition(x, y float32) error {
+	s := e.scene
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	if !e.inMap {
+		return aoi.ErrEntityNotFound
+	}
+	return s.move(e, aoi.Position{X: x, Y: y, Z: e.PositionZ})
+}
+
+func (e *Entity) ChangePosition3D(x, y, z float32) error {
+	s := e.scene
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	if !e.inMap {
+		return aoi.ErrEntityNotFound
+	}
+	return s.move(e, aoi.Position{X: x, Y: y, Z: z})
+}
+
+// 以gridId为中心，(2*RadiusX+1) * (2*RadiusY+1) * (2*RadiusZ+1)范围内的格子，有边界时在地图边缘截断
+func (s *Scene) getSightGridIds(gridId uint64) (gridIds []uint64) {
+	xIndex, yIndex, zIndex := calculateBYByGridId(gridId)
+	minX, maxX := xIndex-s.config.RadiusX, xIndex+s.config.RadiusX
+	minY, maxY := yIndex-s.config.RadiusY, yIndex+s.config.RadiusY
+	minZ, maxZ := zIndex-s.config.RadiusZ, zIndex+s.config.RadiusZ
+	if s.config.bounded() {
+		minX, maxX = clamp(minX, 0, s.maxXIndex), clamp(maxX, 0, s.maxXIndex)
+		minY, maxY = clamp(minY, 0, s.maxYIndex), clamp(maxY, 0, s.maxYIndex)
+	}
+	// 下标范围的边上不能绕回另一头
+	minX, maxX = clamp(minX, minCellIndex, maxCellIndex), clamp(maxX, minCellIndex, maxCellIndex)
+	minY, maxY = clamp(minY, minCellIndex, maxCellIndex), clamp(maxY, minCellIndex, maxCellIndex)
+	minZ, maxZ = clamp(minZ, minFloorIndex, maxFloorIndex), clamp(maxZ, minFloorIndex, maxFloorIndex)
+	gridIds = make([]uint64, 0, (maxX-minX+1)*(maxY-minY+1)*(maxZ-minZ+1))
+	for x := minX; x <= maxX; x++ {
+		for y := minY; y <= maxY; y++ {
+			for z := minZ; z <= maxZ; z++ {
+				gridIds = append(gridIds, calculateGridIdByXYZ(x, y, z))
 			}
 		}
 	}
+	return gridIds
+}
 
-	// 发送坐标改变信息
-	for _, grid := range currentGrids {
-		grid.DoAction(e, TypeChangePosition)
-	}
+// 格子ID里各个下标的范围，进入或移动到范围外的格子返回aoi.ErrOutOfBounds
+const (
+	minCellIndex  = -1 << 23
+	maxCellIndex  = 1<<23 - 1
+	minFloorIndex = -1 << 15
+	maxFloorIndex = 1<<15 - 1
+)
+
+func validCell(xIndex, yIndex, zIndex int) bool {
+	return xIndex >= minCellIndex && xIndex <= maxCellIndex && yIndex >= minCellIndex && yIndex <= maxCellIndex &&
+		zIndex >= minFloorIndex && zIndex <= maxFloorIndex
 }
 
-// 根据位置计算格子ID
-func (e *Entity) setGridId() {
-	e.GridId = calculateGridIdByXY(uint64(e.PositionX/gridSize), uint64(e.PositionY/gridSize))
+// 高24位存X下标，中间24位存Y下标，低16位存层下标，下标可以为负，调用方需要保证下标在范围内
+func calculateGridIdByXYZ(xIndex, yIndex, zIndex int) (gridId uint64) {
+	return uint64(xIndex)&0xFFFFFF<<40 | uint64(yIndex)&0xFFFFFF<<16 | uint64(zIndex)&0xFFFF
 }
 
-func changeSlice2Map(s []uint64) (m map[uint64]struct{}) {
-	m = make(map[uint64]struct{}, len(s))
-	for _, v := range s {
-		m[v] = struct{}{}
-	}
+func calculateBYByGridId(gridId uint64) (xIndex, yIndex, zIndex int) {
+	// 先左移到最高位再算术右移，恢复符号
+	xIndex = int(int64(gridId) >> 40)
+	yIndex = int(int64(gridId<<24) >> 40)
+	zIndex = int(int64(gridId<<48) >> 48)
 	return
 }
 
-// 九宫格
-func getSightGridIds(gridId uint64) (gridIds []uint64) {
-	xIndex, yIndex := calculateBYByGridId(gridId)
-	gridIds = append(gridIds, calculateGridIdByXY(xIndex-1, yIndex-1))
-	gridIds = append(gridIds, calculateGridIdByXY(xIndex, yIndex-1))
-	gridIds = append(gridIds, calculateGridIdByXY(xIndex+1, yIndex-1))
-	gridIds = append(gridIds, calculateGridIdByXY(xIndex-1, yIndex))
-	gridIds = append(gridIds, calculateGridIdByXY(xIndex, yIndex))
-	gridIds = append(gridIds, calculateGridIdByXY(xIndex+1, yIndex))
-	gridIds = append(gridIds, calculateGridIdByXY(xIndex-1, yIndex+1))
-	gridIds = append(gridIds, calculateGridIdByXY(xIndex, yIndex+1))
-	gridIds = append(gridIds, calculateGridIdByXY(xIndex+1, yIndex+1))
-	return gridIds
+// 三维场景包含Z轴的距离平方，统一用float64计算，避免float32的误差影响边界上的判断
+func (s *Scene) distance2(a, b aoi.Position) float64 {
+	dx, dy := float64(a.X)-float64(b.X), float64(a.Y)-float64(b.Y)
+	if !s.config.is3D() {
+		return dx*dx + dy*dy
+	}
+	dz := float64(a.Z) - float64(b.Z)
+	return dx*dx + dy*dy + dz*dz
 }
 
-func calculateGridIdByXY(xIndex, yIndex uint64) (gridId uint64) {
-	return xIndex<<32 + yIndex
+// 以origin为原点、边长为size时v所在格子的下标，向下取整，保证负坐标落在正确的格子里
+// float32转成float64之后相减、相除都是精确的或者只在很低的位上舍入，刚好在边界上的值一定落在右边的格子
+func cellIndex(v, origin float32, size int) int {
+	return int(math.Floor((float64(v) - float64(origin)) / float64(size)))
 }
 
-func calculateBYByGridId(gridId uint64) (xIndex, yIndex uint64) {
-	xIndex, yIndex = gridId>>32, gridId&0x00000000FFFFFFFF
-	return
+func clamp(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
 }
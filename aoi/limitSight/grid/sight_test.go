@@ -1,22 +1,555 @@
 package grid
 
-import "testing"
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"game-toolkit/aoi"
+	"game-toolkit/aoi/aoitest"
+)
+
+type recorder struct {
+	events []aoi.Event
+}
+
+func (r *recorder) OnEvent(ev aoi.Event) {
+	r.events = append(r.events, ev)
+}
+
+func (r *recorder) has(category aoi.EventType, targetId int64) bool {
+	for _, ev := range r.events {
+		if ev.Type == category && ev.TargetId == targetId {
+			return true
+		}
+	}
+	return false
+}
 
 func TestEntity(t *testing.T) {
-	e1 := NewEntity()
-	e2 := NewEntity()
-	e3 := NewEntity()
-	e4 := NewEntity()
+	scene := NewScene(Config{})
+	e1 := scene.NewEntity()
+	e2 := scene.NewEntity()
+	e3 := scene.NewEntity()
+	e4 := scene.NewEntity()
+	r1, r2, r3, r4 := &recorder{}, &recorder{}, &recorder{}, &recorder{}
+	e1.Listener, e2.Listener, e3.Listener, e4.Listener = r1, r2, r3, r4
 
 	e1.EnterMap(1, 1)
 	e2.EnterMap(2, 2)
 	e3.EnterMap(15, 10)
 	e4.EnterMap(25, 10)
+	if !r1.has(aoi.EventEnter, e2.Id) || !r2.has(aoi.EventSync, e1.Id) {
+		t.Fatalf("e1 and e2 should see each other")
+	}
+	if !r3.has(aoi.EventEnter, e4.Id) || !r4.has(aoi.EventSync, e3.Id) {
+		t.Fatalf("e3 and e4 should see each other")
+	}
+	if r1.has(aoi.EventEnter, e4.Id) {
+		t.Fatalf("e1 should not see e4")
+	}
 
 	e1.ChangePosition(35, 11)
+	if !r2.has(aoi.EventLeave, e1.Id) {
+		t.Fatalf("e2 should receive e1 leave sight")
+	}
+	if !r4.has(aoi.EventEnter, e1.Id) || r4.has(aoi.EventMove, e1.Id) {
+		t.Fatalf("e4 should receive e1 enter sight only")
+	}
+	e1.ChangePosition(36, 11)
+	if !r4.has(aoi.EventMove, e1.Id) {
+		t.Fatalf("e4 should receive e1 move")
+	}
 
 	e1.LeaveMap()
 	e2.LeaveMap()
 	e3.LeaveMap()
 	e4.LeaveMap()
 }
+
+func TestSceneIsolation(t *testing.T) {
+	s1 := NewScene(Config{})
+	s2 := NewScene(Config{GridSize: 50})
+
+	a := s1.NewEntity()
+	b := s2.NewEntity()
+	a.EnterMap(1, 1)
+	b.EnterMap(1, 1)
+	if s1.EntityCount() != 1 || s2.EntityCount() != 1 {
+		t.Fatalf("entity count: s1 %d, s2 %d", s1.EntityCount(), s2.EntityCount())
+	}
+
+	a.ChangePosition(60, 1)
+	if a.GridId == calculateGridIdByXYZ(0, 0, 0) {
+		t.Fatalf("entity a should have left grid 0")
+	}
+	b.ChangePosition(40, 1)
+	if b.GridId != calculateGridIdByXYZ(0, 0, 0) {
+		t.Fatalf("entity b should stay in grid 0 with grid size 50")
+	}
+
+	s1.Close()
+	if s1.EntityCount() != 0 || s2.EntityCount() != 1 {
+		t.Fatalf("close s1 should not affect s2")
+	}
+	b.LeaveMap()
+	if s2.EntityCount() != 0 {
+		t.Fatalf("entity b should have left s2")
+	}
+}
+
+// 以指定id进入之后，NewEntity不会再生成这个id，同样id的Entity也进不来
+func TestDuplicateId(t *testing.T) {
+	scene := NewScene(Config{})
+	id := atomic.LoadInt64(&EntityIdGen) + 1
+	if err := scene.Enter(id, aoi.Position{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if e := scene.NewEntity(); e.Id == id {
+		t.Fatalf("NewEntity reused id %d", id)
+	}
+	dup := scene.NewEntity()
+	dup.Id = id
+	if err := dup.EnterMap(1, 1); err != aoi.ErrEntityExists {
+		t.Fatalf("enter with duplicate id: %v", err)
+	}
+	scene.Leave(id)
+	if scene.EntityCount() != 0 || len(scene.GridCache) != 0 {
+		t.Fatalf("scene should be empty: %d entities, %d cells", scene.EntityCount(), len(scene.GridCache))
+	}
+}
+
+func TestConformance(t *testing.T) {
+	aoitest.RunConformance(t, func() aoi.Scene { return NewScene(Config{}) }, aoitest.Options{})
+	aoitest.RunConformance(t, func() aoi.Scene { return NewScene(Config{Batch: true}) }, aoitest.Options{})
+	aoitest.RunConformance(t, func() aoi.Scene { return NewScene(Config{Hysteresis: 3}) }, aoitest.Options{})
+	// 不限制数量时和内部场景的结果完全一致
+	aoitest.RunConformance(t, func() aoi.Scene { return aoi.NewCappedScene(NewScene(Config{}), 0, nil) }, aoitest.Options{})
+}
+
+func TestCapped(t *testing.T) {
+	aoitest.RunCapped(t, func() aoi.Scene { return NewScene(Config{}) })
+	aoitest.RunCapped(t, func() aoi.Scene { return NewScene(Config{Batch: true}) })
+}
+
+func TestSnapshot(t *testing.T) {
+	aoitest.RunSnapshot(t, func() aoi.Scene { return NewScene(Config{}) })
+	aoitest.RunSnapshot(t, func() aoi.Scene { return NewScene(Config{Batch: true, ViewDistance: 15}) })
+
+	// 恢复之后新建的Entity不会和快照里的id冲突
+	scene := NewScene(Config{})
+	id := EntityIdGen + 100
+	if err := scene.Restore(aoi.Snapshot{Entities: []aoi.EntitySnapshot{{Id: id}}}, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if e := scene.NewEntity(); e.Id <= id {
+		t.Fatalf("new entity id %d should be greater than restored %d", e.Id, id)
+	}
+	// 越界的快照整体失败
+	bounded := NewScene(Config{MaxX: 100, MaxY: 100})
+	snap := aoi.Snapshot{Entities: []aoi.EntitySnapshot{{Id: 1}, {Id: 2, Position: aoi.Position{X: 200}}}}
+	if err := bounded.Restore(snap, nil, false); err != aoi.ErrOutOfBounds || bounded.EntityCount() != 0 {
+		t.Fatalf("out of bounds restore: %v", err)
+	}
+	// 无限大的地图上超出格子下标范围的同样整体失败
+	unbounded := NewScene(Config{})
+	snap = aoi.Snapshot{Entities: []aoi.EntitySnapshot{{Id: 1}, {Id: 2, Position: aoi.Position{X: 1e9}}}}
+	if err := unbounded.Restore(snap, nil, false); err != aoi.ErrOutOfBounds || unbounded.EntityCount() != 0 {
+		t.Fatalf("restore beyond index range: %v", err)
+	}
+}
+
+func TestOcclusion(t *testing.T) {
+	aoitest.RunOcclusion(t, func() aoi.Scene { return NewScene(Config{}) })
+	aoitest.RunOcclusion(t, func() aoi.Scene { return NewScene(Config{Batch: true, ViewDistance: 15, ViewShape: ViewCircle}) })
+}
+
+func TestWorld(t *testing.T) {
+	aoitest.RunWorld(t, func() aoi.Scene { return NewScene(Config{}) })
+	aoitest.RunWorld(t, func() aoi.Scene { return NewScene(Config{Batch: true}) })
+}
+
+func TestRadius(t *testing.T) {
+	// 5x5，格子边长20
+	scene := NewScene(Config{GridSize: 20, RadiusX: 2, RadiusY: 2})
+	if err := scene.Enter(1, aoi.Position{X: 45, Y: 45}, nil); err != nil {
+		t.Fatal(err)
+	}
+	r := &recorder{}
+	if err := scene.Enter(2, aoi.Position{X: 85, Y: 5}, r); err != nil {
+		t.Fatal(err)
+	}
+	if !r.has(aoi.EventSync, 1) {
+		t.Fatalf("entity 2 should see entity 1 two grids away")
+	}
+	r.events = nil
+	_ = scene.Move(2, aoi.Position{X: 105, Y: 5})
+	if !r.has(aoi.EventLeave, 1) {
+		t.Fatalf("entity 2 should lose entity 1 three grids away")
+	}
+
+	// 宽屏: 横向看3格，纵向看1格
+	scene = NewScene(Config{RadiusX: 3, RadiusY: 1})
+	_ = scene.Enter(1, aoi.Position{X: 5, Y: 5}, nil)
+	_ = scene.Enter(2, aoi.Position{X: 35, Y: 5}, nil)
+	_ = scene.Enter(3, aoi.Position{X: 5, Y: 25}, nil)
+	if got := scene.Visible(1); len(got) != 1 || got[0] != 2 {
+		t.Fatalf("visible of 1 is %v, expect [2]", got)
+	}
+	r = &recorder{}
+	_ = scene.Leave(3)
+	_ = scene.Enter(3, aoi.Position{X: 5, Y: 25}, r)
+	if len(r.events) != 0 {
+		t.Fatalf("entity 3 should see nobody two grids up, got %+v", r.events)
+	}
+	_ = scene.Move(3, aoi.Position{X: 5, Y: 15})
+	if !r.has(aoi.EventSync, 1) || !r.has(aoi.EventSync, 2) {
+		t.Fatalf("entity 3 should see entity 1 and 2 after moving down, got %+v", r.events)
+	}
+	_ = scene.Move(3, aoi.Position{X: 65, Y: 15})
+	if !r.has(aoi.EventLeave, 1) || r.has(aoi.EventLeave, 2) {
+		t.Fatalf("entity 3 should only lose entity 1 after moving right, got %+v", r.events)
+	}
+}
+
+func TestNegativePosition(t *testing.T) {
+	scene := NewScene(Config{})
+	r := &recorder{}
+	_ = scene.Enter(1, aoi.Position{X: -1, Y: -1}, nil)
+	_ = scene.Enter(2, aoi.Position{X: 1, Y: 1}, r)
+	if !r.has(aoi.EventSync, 1) {
+		t.Fatalf("entity 2 should see entity 1 in the neighbour grid")
+	}
+	if x, y, _ := calculateBYByGridId(scene.GetEntity(1).GridId); x != -1 || y != -1 {
+		t.Fatalf("entity 1 should be in grid (-1, -1), got (%d, %d)", x, y)
+	}
+	_ = scene.Move(1, aoi.Position{X: -11, Y: -1})
+	if !r.has(aoi.EventLeave, 1) {
+		t.Fatalf("entity 2 should lose entity 1 two grids away")
+	}
+}
+
+func TestBounds(t *testing.T) {
+	scene := NewScene(Config{MinX: -50, MinY: -50, MaxX: 49, MaxY: 49})
+	if err := scene.Enter(1, aoi.Position{X: -50, Y: -50}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(scene.getSightGridIds(scene.GetEntity(1).GridId)); got != 4 {
+		t.Fatalf("corner grid should have 4 sight grids, got %d", got)
+	}
+	if err := scene.Enter(2, aoi.Position{X: 50, Y: 0}, nil); !errors.Is(err, aoi.ErrOutOfBounds) {
+		t.Fatalf("enter out of bounds: %v", err)
+	}
+	if err := scene.Move(1, aoi.Position{X: -51, Y: 0}); !errors.Is(err, aoi.ErrOutOfBounds) {
+		t.Fatalf("move out of bounds: %v", err)
+	}
+	if e := scene.GetEntity(1); e.PositionX != -50 || e.PositionY != -50 {
+		t.Fatalf("rejected move should keep position, got (%v, %v)", e.PositionX, e.PositionY)
+	}
+	if err := scene.Move(1, aoi.Position{X: 49, Y: 49}); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(scene.getSightGridIds(scene.GetEntity(1).GridId)); got != 4 {
+		t.Fatalf("corner grid should have 4 sight grids, got %d", got)
+	}
+}
+
+// 格子ID的下标范围有限，无限大的地图上超出范围的位置要拒绝，范围边上的格子不能绕回另一头
+func TestCellIndexRange(t *testing.T) {
+	scene := NewScene(Config{GridSize: 1})
+	if err := scene.Enter(1, aoi.Position{X: 1 << 24}, nil); !errors.Is(err, aoi.ErrOutOfBounds) {
+		t.Fatalf("enter beyond index range: %v", err)
+	}
+	scene.Enter(2, aoi.Position{X: 1<<23 - 0.5}, nil)
+	scene.Enter(3, aoi.Position{X: -1 << 23}, nil)
+	if len(scene.Visible(2)) != 0 || len(scene.Visible(3)) != 0 {
+		t.Fatalf("cells at both ends of the index range should not see each other")
+	}
+	if err := scene.Move(2, aoi.Position{X: 1 << 23}); !errors.Is(err, aoi.ErrOutOfBounds) {
+		t.Fatalf("move beyond index range: %v", err)
+	}
+	if got := scene.QueryNearest(aoi.Position{X: 1 << 30}, 1, nil); len(got) != 1 || got[0] != 2 {
+		t.Fatalf("nearest to a far point: %v", got)
+	}
+
+	floors := NewScene(Config{FloorHeight: 1})
+	if err := floors.Enter(1, aoi.Position{Z: 1 << 16}, nil); !errors.Is(err, aoi.ErrOutOfBounds) {
+		t.Fatalf("enter beyond floor range: %v", err)
+	}
+	floors.Enter(2, aoi.Position{Z: 1<<15 - 1}, nil)
+	floors.Enter(3, aoi.Position{Z: -1 << 15}, nil)
+	if len(floors.Visible(2)) != 0 || len(floors.Visible(3)) != 0 {
+		t.Fatalf("floors at both ends of the range should not see each other")
+	}
+}
+
+func TestViewDistance(t *testing.T) {
+	// 29个单位的距离在九宫格里可见，但超出了视野距离
+	scene := NewScene(Config{GridSize: 10, ViewDistance: 15, ViewShape: ViewCircle})
+	_ = scene.Enter(1, aoi.Position{X: 1, Y: 5}, nil)
+	r := &recorder{}
+	_ = scene.Enter(2, aoi.Position{X: 30, Y: 5}, r)
+	if len(r.events) != 0 {
+		t.Fatalf("entity 2 should not see entity 1 29 units away, got %+v", r.events)
+	}
+	// 同一个格子内移动也会改变可见性
+	_ = scene.Move(2, aoi.Position{X: 15, Y: 5})
+	if !r.has(aoi.EventSync, 1) {
+		t.Fatalf("entity 2 should see entity 1 14 units away")
+	}
+	// 斜对角11个单位在圆形视野内
+	_ = scene.Move(2, aoi.Position{X: 9, Y: 13})
+	if r.has(aoi.EventLeave, 1) {
+		t.Fatalf("entity 2 should still see entity 1")
+	}
+	_ = scene.Move(2, aoi.Position{X: 12, Y: 16})
+	if !r.has(aoi.EventLeave, 1) {
+		t.Fatalf("entity 2 should lose entity 1 out of the circle")
+	}
+
+	// 正方形视野，(12, 16)到(1, 5)的|dx|和|dy|都不超过15
+	scene = NewScene(Config{GridSize: 10, ViewDistance: 15, ViewShape: ViewSquare})
+	_ = scene.Enter(1, aoi.Position{X: 1, Y: 5}, nil)
+	_ = scene.Enter(2, aoi.Position{X: 12, Y: 16}, nil)
+	if got := scene.Visible(2); len(got) != 1 || got[0] != 1 {
+		t.Fatalf("visible of 2 is %v, expect [1]", got)
+	}
+	// 视野格子自动扩大到2圈，相隔一个格子的Entity也需要检查
+	_ = scene.Enter(3, aoi.Position{X: 24, Y: 20}, nil)
+	if got := scene.Visible(3); len(got) != 1 || got[0] != 2 {
+		t.Fatalf("visible of 3 is %v, expect [2]", got)
+	}
+	_ = scene.Move(1, aoi.Position{X: 9, Y: 20})
+	if got := scene.Visible(3); len(got) != 2 {
+		t.Fatalf("visible of 3 is %v, expect [1 2]", got)
+	}
+}
+
+type batchRecorder struct {
+	batches []aoi.Batch
+}
+
+func (r *batchRecorder) OnEvent(ev aoi.Event) {}
+
+func (r *batchRecorder) OnBatch(b aoi.Batch) {
+	r.batches = append(r.batches, b)
+}
+
+func TestBatch(t *testing.T) {
+	scene := NewScene(Config{Batch: true})
+	r := &batchRecorder{}
+	_ = scene.Enter(1, aoi.Position{X: 5, Y: 5}, r)
+	for id := int64(2); id <= 10; id++ {
+		_ = scene.Enter(id, aoi.Position{X: float32(id), Y: 5}, nil)
+	}
+	for i := 0; i < 5; i++ {
+		_ = scene.Move(2, aoi.Position{X: float32(2 + i), Y: 6})
+	}
+	if len(r.batches) != 0 {
+		t.Fatalf("events should be buffered until flush")
+	}
+	scene.Flush()
+	if len(r.batches) != 1 {
+		t.Fatalf("expect 1 batch, got %d", len(r.batches))
+	}
+	b := r.batches[0]
+	if len(b.Enters) != 9 || len(b.Moves) != 0 || len(b.Leaves) != 0 {
+		t.Fatalf("unexpected batch %+v", b)
+	}
+	for _, ev := range b.Enters {
+		if ev.TargetId == 2 && ev.Position != (aoi.Position{X: 6, Y: 6}) {
+			t.Fatalf("enter of 2 should carry the latest position, got %+v", ev.Position)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		_ = scene.Move(3, aoi.Position{X: 3, Y: float32(6 + i)})
+	}
+	_ = scene.Leave(4)
+	scene.Flush()
+	b = r.batches[1]
+	if len(b.Moves) != 1 || b.Moves[0].Position != (aoi.Position{X: 3, Y: 10}) || len(b.Leaves) != 1 {
+		t.Fatalf("unexpected batch %+v", b)
+	}
+}
+
+func TestVisibility(t *testing.T) {
+	team := map[int64]int{1: 1, 2: 1, 3: 2, 4: 1}
+	scene := NewScene(Config{Filter: func(watcher, target int64) bool {
+		// 4是只有队伍1能看到的NPC
+		return target != 4 || team[watcher] == 1
+	}})
+	r1, r2, r3 := &recorder{}, &recorder{}, &recorder{}
+	scene.Enter(1, aoi.Position{X: 1, Y: 1}, r1)
+	scene.Enter(2, aoi.Position{X: 2, Y: 2}, r2)
+	scene.Enter(3, aoi.Position{X: 3, Y: 3}, r3)
+	scene.Enter(4, aoi.Position{X: 4, Y: 4}, nil)
+	if !r1.has(aoi.EventEnter, 4) || r3.has(aoi.EventEnter, 4) {
+		t.Fatalf("only team 1 should see npc 4")
+	}
+
+	// 隐身的GM能看到别人，别人看不到GM
+	gm := &recorder{}
+	scene.Enter(5, aoi.Position{X: 5, Y: 5}, gm)
+	scene.SetVisibility(5, aoi.Visibility{Mask: aoi.DefaultVisibility.Mask})
+	if !r1.has(aoi.EventLeave, 5) || !r3.has(aoi.EventLeave, 5) {
+		t.Fatalf("others should lose the invisible gm")
+	}
+	if gm.has(aoi.EventLeave, 1) || len(scene.Visible(5)) != 3 {
+		t.Fatalf("gm should still see everyone: %v", scene.Visible(5))
+	}
+	for _, id := range scene.Visible(1) {
+		if id == 5 {
+			t.Fatalf("1 should not see gm")
+		}
+	}
+
+	// 2潜行，1和3都没有反隐看不到2，1加上反隐之后能看到2
+	scene.SetVisibility(2, aoi.Visibility{Layer: aoi.LayerStealth, Mask: aoi.LayerDefault})
+	if !r3.has(aoi.EventLeave, 2) || !r1.has(aoi.EventLeave, 2) {
+		t.Fatalf("stealth 2 should leave sight of 1 and 3")
+	}
+	r1.events, r3.events = nil, nil
+	scene.SetVisibility(1, aoi.Visibility{Layer: aoi.LayerDefault, Mask: aoi.LayerDefault | aoi.LayerStealth})
+	if !r1.has(aoi.EventSync, 2) || r3.has(aoi.EventSync, 2) {
+		t.Fatalf("only 1 should see stealth 2 again")
+	}
+
+	// 3换到队伍1之后刷新，能看到NPC
+	team[3] = 1
+	scene.Refresh(3)
+	if !r3.has(aoi.EventSync, 4) {
+		t.Fatalf("3 should see npc 4 after joining team 1")
+	}
+	if err := scene.Refresh(100); !errors.Is(err, aoi.ErrEntityNotFound) {
+		t.Fatalf("refresh unknown: %v", err)
+	}
+}
+
+func TestFloors(t *testing.T) {
+	scene := NewScene(Config{FloorHeight: 10})
+	r1, r2 := &recorder{}, &recorder{}
+	scene.Enter(1, aoi.Position{X: 1, Y: 1, Z: 0}, r1)
+	scene.Enter(2, aoi.Position{X: 2, Y: 2, Z: 15}, r2)
+	scene.Enter(3, aoi.Position{X: 3, Y: 3, Z: -5}, nil)
+	if len(scene.Visible(1)) != 0 || len(scene.Visible(2)) != 0 {
+		t.Fatalf("different floors should not see each other: %v %v", scene.Visible(1), scene.Visible(2))
+	}
+
+	// 2下楼
+	scene.Move(2, aoi.Position{X: 2, Y: 2, Z: 5})
+	if !r1.has(aoi.EventEnter, 2) || !r2.has(aoi.EventSync, 1) {
+		t.Fatalf("1 and 2 should see each other on the same floor")
+	}
+	if x, y, z := calculateBYByGridId(scene.GetEntity(3).GridId); x != 0 || y != 0 || z != -1 {
+		t.Fatalf("entity 3 grid index (%d, %d, %d)", x, y, z)
+	}
+	if got := scene.QueryRadius(aoi.Position{X: 0, Y: 0, Z: 0}, 6); len(got) != 2 {
+		t.Fatalf("sphere query: %v", got)
+	}
+
+	// 飞行地图: 上下各能看一层，并且按三维距离判断
+	sky := NewScene(Config{FloorHeight: 10, RadiusZ: 1, ViewDistance: 10, ViewShape: ViewCircle})
+	r1 = &recorder{}
+	sky.Enter(1, aoi.Position{X: 0, Y: 0, Z: 0}, r1)
+	sky.Enter(2, aoi.Position{X: 0, Y: 0, Z: 9}, nil)
+	sky.Enter(3, aoi.Position{X: 6, Y: 0, Z: 9}, nil)
+	sky.Enter(4, aoi.Position{X: 0, Y: 0, Z: 25}, nil)
+	if !r1.has(aoi.EventEnter, 2) || r1.has(aoi.EventEnter, 3) || r1.has(aoi.EventEnter, 4) {
+		t.Fatalf("1 should see 2 only: %v", sky.Visible(1))
+	}
+	sky.GetEntity(1).ChangePosition3D(0, 0, 16)
+	if !r1.has(aoi.EventSync, 3) || !r1.has(aoi.EventSync, 4) || r1.has(aoi.EventLeave, 2) {
+		t.Fatalf("1 should see 2, 3 and 4 after flying up: %v", sky.Visible(1))
+	}
+}
+
+func TestCellBoundary(t *testing.T) {
+	scene := NewScene(Config{GridSize: 10})
+	cases := []struct {
+		x     float32
+		index int
+	}{
+		{9.999, 0}, {10, 1}, {10.001, 1}, {-0.001, -1}, {-10, -1}, {-10.001, -2},
+	}
+	for i, c := range cases {
+		id := int64(i + 1)
+		scene.Enter(id, aoi.Position{X: c.x, Y: 0.5}, nil)
+		if x, _, _ := calculateBYByGridId(scene.GetEntity(id).GridId); x != c.index {
+			t.Fatalf("x %v should be in cell %d, got %d", c.x, c.index, x)
+		}
+	}
+
+	// 九宫格: 0号格子看得到1号格子，看不到2号格子
+	r := &recorder{}
+	scene.Enter(100, aoi.Position{X: 0, Y: 0.5}, r)
+	scene.Enter(101, aoi.Position{X: 19.99, Y: 0.5}, nil)
+	scene.Enter(102, aoi.Position{X: 20, Y: 0.5}, nil)
+	if !r.has(aoi.EventEnter, 101) || r.has(aoi.EventEnter, 102) {
+		t.Fatalf("100 should see 101 only")
+	}
+}
+
+// 统计某个Target的enter和leave次数
+func (r *recorder) count(targetId int64) (enters, leaves int) {
+	for _, ev := range r.events {
+		if ev.TargetId != targetId {
+			continue
+		}
+		switch ev.Type {
+		case aoi.EventEnter, aoi.EventSync:
+			enters++
+		case aoi.EventLeave:
+			leaves++
+		}
+	}
+	return
+}
+
+func TestHysteresis(t *testing.T) {
+	oscillate := func(config Config, watcherPos aoi.Position, a, b, far aoi.Position) (enters, leaves int, left bool) {
+		scene := NewScene(config)
+		r := &recorder{}
+		scene.Enter(1, watcherPos, r)
+		scene.Enter(2, a, nil)
+		for i := 0; i < 10; i++ {
+			scene.Move(2, b)
+			scene.Move(2, a)
+		}
+		enters, leaves = r.count(2)
+		scene.Move(2, far)
+		_, total := r.count(2)
+		return enters, leaves, total > leaves
+	}
+
+	// 在格子边界上来回移动: 19.9在1号格子，20.1在2号格子
+	a, b := aoi.Position{X: 19.9, Y: 5}, aoi.Position{X: 20.1, Y: 5}
+	if enters, leaves, _ := oscillate(Config{}, aoi.Position{X: 5, Y: 5}, a, b, b); enters != 11 || leaves != 10 {
+		t.Fatalf("without hysteresis: %d enters, %d leaves", enters, leaves)
+	}
+	enters, leaves, left := oscillate(Config{Hysteresis: 1}, aoi.Position{X: 5, Y: 5}, a, b, aoi.Position{X: 26.5, Y: 5})
+	if enters != 1 || leaves != 0 || !left {
+		t.Fatalf("cell hysteresis: %d enters, %d leaves, left %v", enters, leaves, left)
+	}
+
+	// 在视野距离边界上来回移动
+	config := Config{ViewDistance: 15, ViewShape: ViewCircle, Hysteresis: 2}
+	a, b = aoi.Position{X: 14.9, Y: 0}, aoi.Position{X: 15.1, Y: 0}
+	enters, leaves, left = oscillate(config, aoi.Position{}, a, b, aoi.Position{X: 17.5, Y: 0})
+	if enters != 1 || leaves != 0 || !left {
+		t.Fatalf("distance hysteresis: %d enters, %d leaves, left %v", enters, leaves, left)
+	}
+
+	// 观察者自己在格子边界上来回移动
+	scene := NewScene(Config{Hysteresis: 1})
+	r := &recorder{}
+	scene.Enter(1, aoi.Position{X: 10.1, Y: 5}, r)
+	scene.Enter(2, aoi.Position{X: 25, Y: 5}, nil)
+	for i := 0; i < 10; i++ {
+		scene.Move(1, aoi.Position{X: 9.9, Y: 5})
+		scene.Move(1, aoi.Position{X: 10.1, Y: 5})
+	}
+	if enters, leaves := r.count(2); enters != 1 || leaves != 0 {
+		t.Fatalf("watcher oscillation: %d enters, %d leaves", enters, leaves)
+	}
+}
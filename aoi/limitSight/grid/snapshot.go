@@ -0,0 +1,55 @@
+package grid
+
+import (
+	"sort"
+
+	"game-toolkit/aoi"
+)
+
+var _ aoi.Snapshotter = (*Scene)(nil)
+
+// Snapshot 导出场景内所有Entity的位置和可见性掩码，视野由Config决定，不需要保存
+func (s *Scene) Snapshot() (snap aoi.Snapshot) {
+	s.Lock()
+	defer s.Unlock()
+	snap.Entities = make([]aoi.EntitySnapshot, 0, len(s.EntityMap))
+	for _, e := range s.EntityMap {
+		snap.Entities = append(snap.Entities, aoi.EntitySnapshot{Id: e.Id, Position: e.position(), Visibility: e.visibility})
+	}
+	sort.Slice(snap.Entities, func(i, j int) bool { return snap.Entities[i].Id < snap.Entities[j].Id })
+	return
+}
+
+// Restore 按快照重建Entity，场景需要使用和导出时相同的Config
+func (s *Scene) Restore(snap aoi.Snapshot, listener func(id int64) aoi.Listener, notify bool) error {
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	// 先整体检查一遍，出错时场景保持不变
+	ids := make(map[int64]struct{}, len(snap.Entities))
+	for _, es := range snap.Entities {
+		if _, ok := s.EntityMap[es.Id]; ok {
+			return aoi.ErrEntityExists
+		}
+		if _, ok := ids[es.Id]; ok {
+			return aoi.ErrEntityExists
+		}
+		if !s.config.contains(es.Position.X, es.Position.Y) || !validCell(s.cellIndexes(es.Position)) {
+			return aoi.ErrOutOfBounds
+		}
+		ids[es.Id] = struct{}{}
+	}
+
+	s.silent = !notify
+	defer func() { s.silent = false }()
+	for _, es := range snap.Entities {
+		e := &Entity{Id: es.Id, scene: s, visibility: es.Visibility}
+		if listener != nil {
+			e.Listener = listener(es.Id)
+		}
+		if err := s.enter(e, es.Position); err != nil {
+			return err
+		}
+		aoi.ReserveId(&EntityIdGen, es.Id)
+	}
+	return nil
+}
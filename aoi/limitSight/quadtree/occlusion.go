@@ -0,0 +1,55 @@
+package quadtree
+
+import "game-toolkit/aoi"
+
+/*
+	[思路]
+	和九宫格一样，遮挡物第一次添加时才创建，变化后重新计算离它不超过ViewDistance的Entity，
+	这些Entity直接用四叉树查出来，不需要遍历整个场景
+*/
+
+var _ aoi.OcclusionScene = (*Scene)(nil)
+
+func (s *Scene) AddOccluder(id int, seg aoi.Segment) {
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	s.occluders.Add(id, seg)
+}
+
+func (s *Scene) RemoveOccluder(id int) error {
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	return s.occluders.Remove(id)
+}
+
+func (s *Scene) SetOccluderEnabled(id int, enabled bool) error {
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	return s.occluders.SetEnabled(id, enabled)
+}
+
+// 以下方法均需要持锁调用
+
+// 重新计算离segs不超过ViewDistance的Entity的可见关系
+func (s *Scene) refreshNear(segs ...aoi.Segment) {
+	d := s.config.ViewDistance
+	affected := make(map[int64]*Entity)
+	for _, seg := range segs {
+		minX, maxX := seg.A.X, seg.B.X
+		if minX > maxX {
+			minX, maxX = maxX, minX
+		}
+		minY, maxY := seg.A.Y, seg.B.Y
+		if minY > maxY {
+			minY, maxY = maxY, minY
+		}
+		s.rangeEntities(minX-d, minY-d, maxX+d, maxY+d, func(e *Entity) {
+			if seg.Near(e.position(), d) {
+				affected[e.Id] = e
+			}
+		})
+	}
+	for _, e := range affected {
+		s.refresh(e, s.getRelatedEntities(e), false)
+	}
+}
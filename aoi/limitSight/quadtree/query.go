@@ -0,0 +1,43 @@
+package quadtree
+
+import "game-toolkit/aoi"
+
+/*
+	[思路]
+	范围查询只遍历和查询范围相交的节点，再按精确距离过滤，人口密集的地方节点更小，查询时多余的Entity也更少
+	四叉树只按X、Y划分，查询同样忽略Z坐标。查询不会产生任何AOI事件
+*/
+
+var _ aoi.RangeQuerier = (*Scene)(nil)
+
+// QueryRadius 查询圆内(含边界)的Entity
+func (s *Scene) QueryRadius(center aoi.Position, radius float32) (result []int64) {
+	if radius < 0 {
+		return
+	}
+	r2 := float64(radius) * float64(radius)
+	s.Lock()
+	defer s.Unlock()
+	s.rangeEntities(center.X-radius, center.Y-radius, center.X+radius, center.Y+radius, func(e *Entity) {
+		dx, dy := float64(e.PositionX)-float64(center.X), float64(e.PositionY)-float64(center.Y)
+		if dx*dx+dy*dy <= r2 {
+			result = append(result, e.Id)
+		}
+	})
+	return
+}
+
+// QueryRect 查询矩形内(含边界)的Entity
+func (s *Scene) QueryRect(min, max aoi.Position) (result []int64) {
+	if min.X > max.X || min.Y > max.Y {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.rangeEntities(min.X, min.Y, max.X, max.Y, func(e *Entity) {
+		if e.PositionX >= min.X && e.PositionX <= max.X && e.PositionY >= min.Y && e.PositionY <= max.Y {
+			result = append(result, e.Id)
+		}
+	})
+	return
+}
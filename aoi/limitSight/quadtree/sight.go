@@ -0,0 +1,379 @@
+package quadtree
+
+import (
+	"math"
+	"sync"
+
+	"game-toolkit/aoi"
+)
+
+/*
+	[思路]
+	九宫格的格子大小固定，地广人稀的野外大量格子是空的，人挤人的主城里单个格子又塞了几百个Entity；
+	十字链表在X坐标扎堆时每次移动都要越过大量节点。四叉树按人口自适应地划分空间:
+	叶子节点里的Entity超过Capacity时一分为四，子树里的Entity少到Capacity/2以下时合并回一个叶子，
+	分裂和合并的阈值不同，Entity在阈值附近来回进出时不会反复分裂合并。节点边长不小于MinSize，
+	大量Entity站在同一个点上时也不会无限分裂
+
+	所有Entity共用同一个视野距离，可见关系是对称的，进场和移动时查询视野范围内的Entity，
+	再加上之前互相可见的Entity作为候选，按差集发送事件，和九宫格的语义完全一致
+	只按X、Y坐标划分，忽略Z坐标；地图需要有边界，未配置时使用±defaultExtent，进入或移动到边界外返回aoi.ErrOutOfBounds
+
+	[并发]
+	和九宫格一样每个场景一把锁，持锁期间只计算可见性的变化，释放锁之后再投递事件，Listener里可以再调用场景的方法
+*/
+
+const (
+	defaultViewDistance = 20
+	defaultCapacity     = 16
+	defaultMinSize      = 4
+	defaultExtent       = 1 << 20
+)
+
+const (
+	ViewSquare = iota // 正方形视野，|dx|和|dy|都不超过ViewDistance
+	ViewCircle        // 圆形视野，dx^2+dy^2不超过ViewDistance^2
+)
+
+type Config struct {
+	ViewDistance float32 // 视野距离，<=0时使用defaultViewDistance
+	ViewShape    int     // ViewSquare or ViewCircle
+
+	Capacity int     // 叶子节点最多容纳的Entity数量，超过后分裂，<=0时使用defaultCapacity
+	MinSize  float32 // 节点的最小边长，<=0时使用defaultMinSize
+
+	Batch bool // 是否开启批量模式，开启后需要每帧调用Flush
+
+	Filter aoi.Filter // 额外的可见性判断，为nil时不过滤
+
+	// 地图边界(闭区间)，全为0时使用[-defaultExtent, defaultExtent]
+	MinX float32
+	MinY float32
+	MaxX float32
+	MaxY float32
+}
+
+func (c Config) contains(x, y float32) bool {
+	return x >= c.MinX && x <= c.MaxX && y >= c.MinY && y <= c.MaxY
+}
+
+type Scene struct {
+	sync.Mutex
+	config     Config
+	root       *node
+	EntityMap  map[int64]*Entity  // 当前在场景内的Entity
+	buffer     *aoi.EventBuffer   // 批量模式下缓存的事件
+	dispatcher aoi.Dispatcher     // 当前这次调用产生的事件，释放锁之后再投递
+	occluders  aoi.SceneOccluders // 遮挡物
+}
+
+var (
+	_ aoi.Scene           = (*Scene)(nil)
+	_ aoi.Flusher         = (*Scene)(nil)
+	_ aoi.VisibilityScene = (*Scene)(nil)
+)
+
+func NewScene(config Config) *Scene {
+	if config.ViewDistance <= 0 {
+		config.ViewDistance = defaultViewDistance
+	}
+	if config.Capacity <= 0 {
+		config.Capacity = defaultCapacity
+	}
+	if config.MinSize <= 0 {
+		config.MinSize = defaultMinSize
+	}
+	if config.MinX == 0 && config.MinY == 0 && config.MaxX == 0 && config.MaxY == 0 {
+		config.MinX, config.MinY, config.MaxX, config.MaxY = -defaultExtent, -defaultExtent, defaultExtent, defaultExtent
+	}
+	s := &Scene{
+		config:    config,
+		root:      newLeaf(nil, config.MinX, config.MinY, config.MaxX, config.MaxY),
+		EntityMap: make(map[int64]*Entity),
+	}
+	s.occluders = aoi.NewSceneOccluders(config.ViewDistance, s.refreshNear)
+	if config.Batch {
+		s.buffer = aoi.NewEventBuffer()
+	}
+	return s
+}
+
+// Close 销毁场景，清空四叉树和Entity，不再发送任何消息
+func (s *Scene) Close() {
+	s.Lock()
+	defer s.Unlock()
+	for _, e := range s.EntityMap {
+		e.leaf = nil
+		e.watching, e.watchedBy = nil, nil
+	}
+	s.root = newLeaf(nil, s.config.MinX, s.config.MinY, s.config.MaxX, s.config.MaxY)
+	s.EntityMap = make(map[int64]*Entity)
+	s.dispatcher.Reset()
+	if s.buffer != nil {
+		s.buffer.Drain()
+	}
+}
+
+// Enter 实现aoi.Scene，以指定id创建Entity并进入场景
+func (s *Scene) Enter(id int64, pos aoi.Position, listener aoi.Listener) error {
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	if _, ok := s.EntityMap[id]; ok {
+		return aoi.ErrEntityExists
+	}
+	if !s.config.contains(pos.X, pos.Y) {
+		return aoi.ErrOutOfBounds
+	}
+	e := &Entity{
+		Id:         id,
+		Listener:   listener,
+		visibility: aoi.DefaultVisibility,
+		watching:   make(map[int64]*Entity),
+		watchedBy:  make(map[int64]*Entity),
+	}
+	e.PositionX, e.PositionY, e.PositionZ = pos.X, pos.Y, pos.Z
+	s.EntityMap[id] = e
+	s.insert(e)
+	s.refresh(e, s.getSightEntities(e), false)
+	return nil
+}
+
+func (s *Scene) Leave(id int64) error {
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	e, ok := s.EntityMap[id]
+	if !ok {
+		return aoi.ErrEntityNotFound
+	}
+	s.remove(e)
+	delete(s.EntityMap, id)
+	for _, other := range e.watchedBy {
+		delete(other.watching, e.Id)
+		s.emit(other, aoi.Event{Type: aoi.EventLeave, WatcherId: other.Id, TargetId: e.Id, Position: e.position()})
+	}
+	for _, other := range e.watching {
+		delete(other.watchedBy, e.Id)
+	}
+	e.watching, e.watchedBy = nil, nil
+	return nil
+}
+
+// Move 移动到边界外时拒绝本次移动，位置保持不变
+func (s *Scene) Move(id int64, pos aoi.Position) error {
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	e, ok := s.EntityMap[id]
+	if !ok {
+		return aoi.ErrEntityNotFound
+	}
+	if !s.config.contains(pos.X, pos.Y) {
+		return aoi.ErrOutOfBounds
+	}
+	e.PositionX, e.PositionY, e.PositionZ = pos.X, pos.Y, pos.Z
+	// 还在原来的叶子里时不需要调整树
+	if s.locate(pos.X, pos.Y) != e.leaf {
+		s.remove(e)
+		s.insert(e)
+	}
+	s.refresh(e, s.getRelatedEntities(e), true)
+	return nil
+}
+
+func (s *Scene) SetVisibility(id int64, v aoi.Visibility) error {
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	e, ok := s.EntityMap[id]
+	if !ok {
+		return aoi.ErrEntityNotFound
+	}
+	e.visibility = v
+	s.refresh(e, s.getRelatedEntities(e), false)
+	return nil
+}
+
+func (s *Scene) Refresh(id int64) error {
+	s.Lock()
+	defer s.dispatcher.UnlockAndDispatch(s)
+	e, ok := s.EntityMap[id]
+	if !ok {
+		return aoi.ErrEntityNotFound
+	}
+	s.refresh(e, s.getRelatedEntities(e), false)
+	return nil
+}
+
+// Visible 获取id当前能看到的Entity
+func (s *Scene) Visible(id int64) (result []int64) {
+	s.Lock()
+	defer s.Unlock()
+	e, ok := s.EntityMap[id]
+	if !ok {
+		return
+	}
+	for otherId := range e.watching {
+		result = append(result, otherId)
+	}
+	return
+}
+
+// Flush 批量模式下把本帧缓存的事件合并后投递给各个Watcher，已经离开场景的Watcher不再投递
+func (s *Scene) Flush() {
+	if s.buffer == nil {
+		return
+	}
+	aoi.FlushBuffer(s, s.buffer, func(watcherId int64) aoi.Listener {
+		if e, ok := s.EntityMap[watcherId]; ok {
+			return e.Listener
+		}
+		return nil
+	})
+}
+
+// EntityCount 当前场景内的Entity数量
+func (s *Scene) EntityCount() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.EntityMap)
+}
+
+// Stats 四叉树当前的形状
+type Stats struct {
+	Nodes  int // 节点总数
+	Leaves int // 叶子节点数
+	Depth  int // 最深的叶子的深度，只有根节点时为0
+}
+
+func (s *Scene) Stats() (stats Stats) {
+	s.Lock()
+	defer s.Unlock()
+	var walk func(n *node, depth int)
+	walk = func(n *node, depth int) {
+		stats.Nodes++
+		if n.leaf() {
+			stats.Leaves++
+			if depth > stats.Depth {
+				stats.Depth = depth
+			}
+			return
+		}
+		for _, child := range n.children {
+			walk(child, depth+1)
+		}
+	}
+	walk(s.root, 0)
+	return
+}
+
+// 以下方法均需要持锁调用
+
+func (s *Scene) emit(watcher *Entity, ev aoi.Event) {
+	if s.buffer != nil {
+		s.buffer.Add(ev)
+		return
+	}
+	s.dispatcher.Add(watcher.Listener, ev)
+}
+
+// 视野范围内的其他Entity，是进场和移动时需要检查的候选集合
+func (s *Scene) getSightEntities(e *Entity) (result map[int64]*Entity) {
+	result = make(map[int64]*Entity)
+	d := s.config.ViewDistance
+	s.rangeEntities(e.PositionX-d, e.PositionY-d, e.PositionX+d, e.PositionY+d, func(other *Entity) {
+		if other != e {
+			result[other.Id] = other
+		}
+	})
+	return
+}
+
+// 需要重新检查可见关系的候选集合: 视野范围内的Entity + 之前互相可见的Entity
+func (s *Scene) getRelatedEntities(e *Entity) (result map[int64]*Entity) {
+	result = s.getSightEntities(e)
+	for id, other := range e.watching {
+		result[id] = other
+	}
+	for id, other := range e.watchedBy {
+		result[id] = other
+	}
+	return
+}
+
+// watcher能否看到target: 先满足视野距离，然后视线不被遮挡，最后是可见性掩码和Filter
+func (s *Scene) canSee(watcher, target *Entity) bool {
+	if watcher == target || !watcher.visibility.CanSee(target.visibility) || !s.inSight(watcher, target) {
+		return false
+	}
+	if s.occluders.Blocked(watcher.position(), target.position()) {
+		return false
+	}
+	return s.config.Filter == nil || s.config.Filter(watcher.Id, target.Id)
+}
+
+// 纯几何上的判断，统一用float64计算
+func (s *Scene) inSight(watcher, target *Entity) bool {
+	d := float64(s.config.ViewDistance)
+	dx := math.Abs(float64(watcher.PositionX) - float64(target.PositionX))
+	dy := math.Abs(float64(watcher.PositionY) - float64(target.PositionY))
+	if s.config.ViewShape == ViewCircle {
+		return dx*dx+dy*dy <= d*d
+	}
+	return dx <= d && dy <= d
+}
+
+// 根据当前位置重新计算e和candidates之间的可见关系，按差集发送事件
+// moved表示e的位置发生了变化，需要通知一直能看到e的Entity
+func (s *Scene) refresh(e *Entity, candidates map[int64]*Entity, moved bool) {
+	for id, other := range candidates {
+		// 我能不能看到对方
+		_, was := e.watching[id]
+		now := s.canSee(e, other)
+		if now && !was {
+			e.watching[id] = other
+			other.watchedBy[e.Id] = e
+			s.emit(e, aoi.Event{Type: aoi.EventSync, WatcherId: e.Id, TargetId: id, Position: other.position()})
+		} else if !now && was {
+			delete(e.watching, id)
+			delete(other.watchedBy, e.Id)
+			s.emit(e, aoi.Event{Type: aoi.EventLeave, WatcherId: e.Id, TargetId: id, Position: other.position()})
+		}
+
+		// 对方能不能看到我
+		_, was = e.watchedBy[id]
+		now = s.canSee(other, e)
+		ev := aoi.Event{WatcherId: id, TargetId: e.Id, Position: e.position()}
+		switch {
+		case now && !was:
+			e.watchedBy[id] = other
+			other.watching[e.Id] = e
+			ev.Type = aoi.EventEnter
+		case !now && was:
+			delete(e.watchedBy, id)
+			delete(other.watching, e.Id)
+			ev.Type = aoi.EventLeave
+		case now && moved:
+			ev.Type = aoi.EventMove
+		default:
+			continue
+		}
+		s.emit(other, ev)
+	}
+}
+
+// Entity 的导出字段只能在持有场景锁时读写
+type Entity struct {
+	Id        int64
+	PositionX float32
+	PositionY float32
+	PositionZ float32
+
+	Listener aoi.Listener // 接收AOI事件，为nil时丢弃事件
+
+	leaf       *node // 所在的叶子节点
+	visibility aoi.Visibility
+	watching   map[int64]*Entity // 我能看到的Entity
+	watchedBy  map[int64]*Entity // 能看到我的Entity
+}
+
+func (e *Entity) position() aoi.Position {
+	return aoi.Position{X: e.PositionX, Y: e.PositionY, Z: e.PositionZ}
+}
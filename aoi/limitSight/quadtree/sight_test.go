@@ -0,0 +1,222 @@
+package quadtree
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"game-toolkit/aoi"
+	"game-toolkit/aoi/aoitest"
+)
+
+func TestConformance(t *testing.T) {
+	aoitest.RunConformance(t, func() aoi.Scene { return NewScene(Config{}) }, aoitest.Options{})
+	aoitest.RunConformance(t, func() aoi.Scene { return NewScene(Config{Batch: true}) }, aoitest.Options{})
+	// 容量很小时几乎每次进出都会分裂合并
+	aoitest.RunConformance(t, func() aoi.Scene { return NewScene(Config{Capacity: 1, ViewShape: ViewCircle}) }, aoitest.Options{})
+}
+
+func TestCapped(t *testing.T) {
+	aoitest.RunCapped(t, func() aoi.Scene { return NewScene(Config{Capacity: 2}) })
+}
+
+func TestWorld(t *testing.T) {
+	aoitest.RunWorld(t, func() aoi.Scene { return NewScene(Config{}) })
+}
+
+func TestOcclusion(t *testing.T) {
+	aoitest.RunOcclusion(t, func() aoi.Scene { return NewScene(Config{Capacity: 2}) })
+	aoitest.RunOcclusion(t, func() aoi.Scene { return NewScene(Config{Batch: true}) })
+}
+
+func TestSplitMerge(t *testing.T) {
+	scene := NewScene(Config{Capacity: 4, MinX: 0, MinY: 0, MaxX: 1024, MaxY: 1024})
+	// 主城里挤了很多人，野外只有一个
+	for id := int64(1); id <= 64; id++ {
+		scene.Enter(id, aoi.Position{X: 100 + float32(id%8), Y: 100 + float32(id/8)}, nil)
+	}
+	scene.Enter(100, aoi.Position{X: 900, Y: 900}, nil)
+	stats := scene.Stats()
+	if stats.Depth < 5 {
+		t.Fatalf("crowded area should split deeply: %+v", stats)
+	}
+	checkTree(t, scene)
+
+	// 人走光了之后合并回根节点
+	for id := int64(1); id <= 64; id++ {
+		scene.Leave(id)
+	}
+	if stats := scene.Stats(); stats.Nodes != 1 {
+		t.Fatalf("tree should merge back into root: %+v", stats)
+	}
+	checkTree(t, scene)
+
+	// 同一个点上站再多人也不会无限分裂
+	for id := int64(1); id <= 64; id++ {
+		scene.Enter(id, aoi.Position{X: 10, Y: 10}, nil)
+	}
+	if stats := scene.Stats(); stats.Depth > 8 {
+		t.Fatalf("split should stop at MinSize: %+v", stats)
+	}
+	checkTree(t, scene)
+}
+
+func TestBounds(t *testing.T) {
+	scene := NewScene(Config{MinX: -10, MinY: -10, MaxX: 10, MaxY: 10})
+	if err := scene.Enter(1, aoi.Position{X: 10, Y: -10}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := scene.Enter(2, aoi.Position{X: 11}, nil); err != aoi.ErrOutOfBounds {
+		t.Fatalf("enter out of bounds: %v", err)
+	}
+	if err := scene.Move(1, aoi.Position{Y: 10.5}); err != aoi.ErrOutOfBounds {
+		t.Fatalf("move out of bounds: %v", err)
+	}
+	if got := scene.QueryRect(aoi.Position{X: 10, Y: -10}, aoi.Position{X: 10, Y: -10}); len(got) != 1 {
+		t.Fatalf("entity should stay at the corner, got %v", got)
+	}
+}
+
+func TestVisibility(t *testing.T) {
+	scene := NewScene(Config{})
+	scene.Enter(1, aoi.Position{}, nil)
+	scene.Enter(2, aoi.Position{X: 1}, nil)
+	scene.SetVisibility(2, aoi.Visibility{Layer: aoi.LayerStealth, Mask: aoi.LayerDefault})
+	if len(scene.Visible(1)) != 0 || len(scene.Visible(2)) != 1 {
+		t.Fatalf("stealth entity should only be seen by detectors")
+	}
+	scene.SetVisibility(1, aoi.Visibility{Layer: aoi.LayerDefault, Mask: aoi.LayerDefault | aoi.LayerStealth})
+	if len(scene.Visible(1)) != 1 {
+		t.Fatalf("detector should see stealth entity")
+	}
+}
+
+// 随机进出、移动之后，可见集合和逐对计算的结果一致，四叉树的计数和叶子归属正确
+func TestRandom(t *testing.T) {
+	for _, config := range []Config{{Capacity: 2}, {Capacity: 8, ViewShape: ViewCircle, ViewDistance: 15}} {
+		t.Run(fmt.Sprintf("%+v", config), func(t *testing.T) {
+			scene := NewScene(config)
+			rnd := rand.New(rand.NewSource(1))
+			randomPos := func() aoi.Position {
+				return aoi.Position{X: float32(rnd.Intn(800)-400) / 4, Y: float32(rnd.Intn(800)-400) / 4}
+			}
+			for i := 0; i < 2000; i++ {
+				id := int64(rnd.Intn(60) + 1)
+				if _, ok := scene.EntityMap[id]; !ok {
+					scene.Enter(id, randomPos(), nil)
+				} else if rnd.Intn(5) == 0 {
+					scene.Leave(id)
+				} else {
+					scene.Move(id, randomPos())
+				}
+				if i%50 == 0 {
+					checkTree(t, scene)
+					checkConsistency(t, scene)
+				}
+			}
+		})
+	}
+}
+
+func TestQuery(t *testing.T) {
+	scene := NewScene(Config{Capacity: 4})
+	positions := make(map[int64]aoi.Position)
+	rnd := rand.New(rand.NewSource(1))
+	for id := int64(1); id <= 300; id++ {
+		pos := aoi.Position{X: float32(rnd.Intn(1600)-800) / 4, Y: float32(rnd.Intn(1600)-800) / 4}
+		positions[id] = pos
+		if err := scene.Enter(id, pos, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 50; i++ {
+		center := aoi.Position{X: float32(rnd.Intn(1600)-800) / 4, Y: float32(rnd.Intn(1600)-800) / 4}
+		radius := float32(rnd.Intn(240)) / 4
+
+		var expect []int64
+		for id, pos := range positions {
+			dx, dy := float64(pos.X)-float64(center.X), float64(pos.Y)-float64(center.Y)
+			if dx*dx+dy*dy <= float64(radius)*float64(radius) {
+				expect = append(expect, id)
+			}
+		}
+		assertIds(t, "radius", scene.QueryRadius(center, radius), expect)
+
+		min := aoi.Position{X: center.X - radius, Y: center.Y - radius/2}
+		max := aoi.Position{X: center.X + radius/2, Y: center.Y + radius}
+		expect = expect[:0]
+		for id, pos := range positions {
+			if pos.X >= min.X && pos.X <= max.X && pos.Y >= min.Y && pos.Y <= max.Y {
+				expect = append(expect, id)
+			}
+		}
+		assertIds(t, "rect", scene.QueryRect(min, max), expect)
+	}
+}
+
+func assertIds(t *testing.T, name string, got, expect []int64) {
+	t.Helper()
+	sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+	sort.Slice(expect, func(i, j int) bool { return expect[i] < expect[j] })
+	if len(got) != len(expect) {
+		t.Fatalf("%s: got %v, expect %v", name, got, expect)
+	}
+	for i := range got {
+		if got[i] != expect[i] {
+			t.Fatalf("%s: got %v, expect %v", name, got, expect)
+		}
+	}
+}
+
+// 每个节点的计数等于子树里的Entity数量，Entity在自己坐标所在的叶子里，子树里的Entity不超过Capacity/2时已经合并
+func checkTree(t *testing.T, scene *Scene) {
+	t.Helper()
+	var walk func(n *node) int
+	walk = func(n *node) int {
+		count := 0
+		if n.leaf() {
+			for _, e := range n.entities {
+				if e.leaf != n || scene.locate(e.PositionX, e.PositionY) != n {
+					t.Fatalf("entity %d in wrong leaf", e.Id)
+				}
+			}
+			count = len(n.entities)
+		} else {
+			if n.count <= scene.config.Capacity/2 {
+				t.Fatalf("sparse node with %d entities should have merged", n.count)
+			}
+			for _, child := range n.children {
+				if child.parent != n {
+					t.Fatalf("broken parent link")
+				}
+				count += walk(child)
+			}
+		}
+		if count != n.count {
+			t.Fatalf("node count %d, expect %d", n.count, count)
+		}
+		return count
+	}
+	if walk(scene.root) != len(scene.EntityMap) {
+		t.Fatalf("tree and entity map mismatch")
+	}
+}
+
+// 可见集合需要和按定义逐对计算的结果一致，且watching和watchedBy互为镜像
+func checkConsistency(t *testing.T, scene *Scene) {
+	t.Helper()
+	for id, e := range scene.EntityMap {
+		for otherId, other := range scene.EntityMap {
+			_, watching := e.watching[otherId]
+			if watching != scene.canSee(e, other) {
+				t.Fatalf("%d watching %d is %v, expect %v", id, otherId, watching, !watching)
+			}
+			_, watchedBy := other.watchedBy[id]
+			if watching != watchedBy {
+				t.Fatalf("%d watching %d is %v, but watchedBy is %v", id, otherId, watching, watchedBy)
+			}
+		}
+	}
+}
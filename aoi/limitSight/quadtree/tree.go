@@ -0,0 +1,151 @@
+package quadtree
+
+// node 四叉树的节点，叶子节点保存Entity，内部节点只记录子树里的Entity数量
+// 子节点按中点划分，坐标小于中点的落在左(下)边，等于中点的落在右(上)边
+type node struct {
+	minX, minY, maxX, maxY float32
+	parent                 *node
+	children               []*node           // 0:左下 1:右下 2:左上 3:右上，叶子节点为nil
+	entities               map[int64]*Entity // 只有叶子节点有
+	count                  int               // 子树里的Entity数量
+}
+
+func newLeaf(parent *node, minX, minY, maxX, maxY float32) *node {
+	return &node{minX: minX, minY: minY, maxX: maxX, maxY: maxY, parent: parent, entities: make(map[int64]*Entity)}
+}
+
+func (n *node) leaf() bool {
+	return n.children == nil
+}
+
+func (n *node) mid() (x, y float32) {
+	return n.minX + (n.maxX-n.minX)/2, n.minY + (n.maxY-n.minY)/2
+}
+
+// (x, y)落在哪个子节点
+func (n *node) child(x, y float32) *node {
+	midX, midY := n.mid()
+	i := 0
+	if x >= midX {
+		i |= 1
+	}
+	if y >= midY {
+		i |= 2
+	}
+	return n.children[i]
+}
+
+// 和闭区间的矩形相交
+func (n *node) intersects(minX, minY, maxX, maxY float32) bool {
+	return n.minX <= maxX && n.maxX >= minX && n.minY <= maxY && n.maxY >= minY
+}
+
+// 以下方法均需要持锁调用
+
+// (x, y)所在的叶子节点
+func (s *Scene) locate(x, y float32) *node {
+	n := s.root
+	for !n.leaf() {
+		n = n.child(x, y)
+	}
+	return n
+}
+
+func (s *Scene) insert(e *Entity) {
+	n := s.root
+	for {
+		n.count++
+		if n.leaf() {
+			break
+		}
+		n = n.child(e.PositionX, e.PositionY)
+	}
+	n.entities[e.Id] = e
+	e.leaf = n
+	if n.count > s.config.Capacity {
+		s.split(n)
+	}
+}
+
+// 叶子里的Entity太多时一分为四，分完之后某个子节点还是太多就继续分，直到边长小于MinSize
+func (s *Scene) split(n *node) {
+	if n.maxX-n.minX < 2*s.config.MinSize || n.maxY-n.minY < 2*s.config.MinSize {
+		return
+	}
+	midX, midY := n.mid()
+	n.children = []*node{
+		newLeaf(n, n.minX, n.minY, midX, midY),
+		newLeaf(n, midX, n.minY, n.maxX, midY),
+		newLeaf(n, n.minX, midY, midX, n.maxY),
+		newLeaf(n, midX, midY, n.maxX, n.maxY),
+	}
+	for id, e := range n.entities {
+		child := n.child(e.PositionX, e.PositionY)
+		child.entities[id] = e
+		child.count++
+		e.leaf = child
+	}
+	n.entities = nil
+	for _, child := range n.children {
+		if child.count > s.config.Capacity {
+			s.split(child)
+		}
+	}
+}
+
+func (s *Scene) remove(e *Entity) {
+	n := e.leaf
+	delete(n.entities, e.Id)
+	e.leaf = nil
+	// 找到最高的一个Entity数量不超过Capacity/2的祖先，把它的整个子树合并成一个叶子
+	var merge *node
+	for ; n != nil; n = n.parent {
+		n.count--
+		if !n.leaf() && n.count <= s.config.Capacity/2 {
+			merge = n
+		}
+	}
+	if merge != nil {
+		s.merge(merge)
+	}
+}
+
+func (s *Scene) merge(n *node) {
+	entities := make(map[int64]*Entity, n.count)
+	var collect func(child *node)
+	collect = func(child *node) {
+		if child.leaf() {
+			for id, e := range child.entities {
+				entities[id] = e
+				e.leaf = n
+			}
+			return
+		}
+		for _, c := range child.children {
+			collect(c)
+		}
+	}
+	collect(n)
+	n.children = nil
+	n.entities = entities
+}
+
+// 遍历与闭区间矩形相交的叶子里的Entity，调用方需要自己按精确的范围过滤
+func (s *Scene) rangeEntities(minX, minY, maxX, maxY float32, f func(e *Entity)) {
+	var walk func(n *node)
+	walk = func(n *node) {
+		if n.count == 0 || !n.intersects(minX, minY, maxX, maxY) {
+			return
+		}
+		if n.leaf() {
+			for _, e := range n.entities {
+				f(e)
+			}
+			return
+		}
+		for _, child := range n.children {
+			walk(child)
+		}
+	}
+	walk(s.root)
+}
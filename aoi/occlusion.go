@@ -0,0 +1,292 @@
+package aoi
+
+import (
+	"errors"
+	"math"
+)
+
+/*
+	[思路]
+	地下城里墙和关着的门会挡住视线。遮挡物统一表示成线段(Segment)，瓦片地图的阻挡掩码通过SegmentsFromTiles转换成
+	阻挡瓦片和可通行瓦片之间的边。几何上在视野范围内之后，watcher和target之间的连线穿过任何一个开启的遮挡物就看不到
+	遮挡物按cellSize分桶，连线只检查它的包围盒覆盖的桶里的线段，连线的长度不超过视野距离，每次判断只看附近的几个桶
+	门打开、关上时只有连线可能穿过这扇门的Entity对需要重新计算，即离门不超过视野距离的Entity，由场景负责找出来，
+	场景通过SceneOccluders持有遮挡物，只需要提供这个重新计算的回调
+	只看X、Y坐标。连线的端点刚好落在遮挡物上(站在墙线上)不算遮挡；遮挡物的端点落在连线上算遮挡，
+	这样两段墙拼接的缝隙不会漏出视线；连线和遮挡物共线时不算遮挡
+*/
+
+var ErrOccluderNotFound = errors.New("aoi: occluder not found")
+
+const defaultOccluderCellSize = 16
+
+type Segment struct {
+	A Position
+	B Position
+}
+
+// OcclusionScene 支持视线遮挡的场景实现该接口，遮挡物的变化会立即重新计算受影响的可见关系
+type OcclusionScene interface {
+	// AddOccluder 添加遮挡物，id已经存在时替换原来的线段，新添加的遮挡物是开启的
+	AddOccluder(id int, seg Segment)
+	// RemoveOccluder 删除遮挡物
+	RemoveOccluder(id int) error
+	// SetOccluderEnabled 开启或关闭遮挡物，比如门关上、打开
+	SetOccluderEnabled(id int, enabled bool) error
+}
+
+type occluder struct {
+	segment Segment
+	enabled bool
+	stamp   uint64 // 同一次判断里已经检查过，一条线段可能同时在多个桶里
+}
+
+type cellKey struct {
+	x, y int
+}
+
+// Occluders 遮挡物的集合，非并发安全，由场景自己加锁
+type Occluders struct {
+	cellSize  float32
+	occluders map[int]*occluder
+	cells     map[cellKey]map[int]*occluder
+	stamp     uint64
+}
+
+// NewOccluders cellSize是分桶的边长，通常和视野距离差不多，<=0时使用defaultOccluderCellSize
+func NewOccluders(cellSize float32) *Occluders {
+	if cellSize <= 0 {
+		cellSize = defaultOccluderCellSize
+	}
+	return &Occluders{cellSize: cellSize, occluders: make(map[int]*occluder), cells: make(map[cellKey]map[int]*occluder)}
+}
+
+func (o *Occluders) Len() int {
+	return len(o.occluders)
+}
+
+// Add 添加开启的遮挡物，id已经存在时替换，返回被替换的线段
+func (o *Occluders) Add(id int, seg Segment) (old Segment, replaced bool) {
+	old, replaced = o.Remove(id)
+	oc := &occluder{segment: seg, enabled: true}
+	o.occluders[id] = oc
+	o.rangeCells(seg.A, seg.B, func(key cellKey) {
+		cell, ok := o.cells[key]
+		if !ok {
+			cell = make(map[int]*occluder)
+			o.cells[key] = cell
+		}
+		cell[id] = oc
+	})
+	return
+}
+
+func (o *Occluders) Remove(id int) (seg Segment, ok bool) {
+	oc, ok := o.occluders[id]
+	if !ok {
+		return
+	}
+	delete(o.occluders, id)
+	o.rangeCells(oc.segment.A, oc.segment.B, func(key cellKey) {
+		delete(o.cells[key], id)
+		if len(o.cells[key]) == 0 {
+			delete(o.cells, key)
+		}
+	})
+	return oc.segment, true
+}
+
+// SetEnabled 开启或关闭遮挡物，返回它的线段，changed表示状态是否发生了变化
+func (o *Occluders) SetEnabled(id int, enabled bool) (seg Segment, changed bool, err error) {
+	oc, ok := o.occluders[id]
+	if !ok {
+		return seg, false, ErrOccluderNotFound
+	}
+	changed = oc.enabled != enabled
+	oc.enabled = enabled
+	return oc.segment, changed, nil
+}
+
+// Blocked a和b之间的连线是否被开启的遮挡物挡住
+func (o *Occluders) Blocked(a, b Position) (blocked bool) {
+	if len(o.occluders) == 0 {
+		return false
+	}
+	o.stamp++
+	o.rangeCells(a, b, func(key cellKey) {
+		if blocked {
+			return
+		}
+		for _, oc := range o.cells[key] {
+			if oc.stamp == o.stamp {
+				continue
+			}
+			oc.stamp = o.stamp
+			if oc.enabled && crosses(a, b, oc.segment.A, oc.segment.B) {
+				blocked = true
+				return
+			}
+		}
+	})
+	return
+}
+
+// 遍历a和b的包围盒覆盖的桶
+func (o *Occluders) rangeCells(a, b Position, f func(key cellKey)) {
+	minX, maxX := o.cellIndex(a.X), o.cellIndex(b.X)
+	if minX > maxX {
+		minX, maxX = maxX, minX
+	}
+	minY, maxY := o.cellIndex(a.Y), o.cellIndex(b.Y)
+	if minY > maxY {
+		minY, maxY = maxY, minY
+	}
+	for x := minX; x <= maxX; x++ {
+		for y := minY; y <= maxY; y++ {
+			f(cellKey{x, y})
+		}
+	}
+}
+
+func (o *Occluders) cellIndex(v float32) int {
+	return int(math.Floor(float64(v) / float64(o.cellSize)))
+}
+
+// SceneOccluders 场景持有的遮挡物，场景加锁之后把OcclusionScene的方法转发过来
+// Occluders在第一次添加时才创建，没有遮挡物的场景Blocked不需要额外的开销；
+// 遮挡物变化后调用refresh，由场景重新计算离这些线段不超过视野距离的Entity的可见关系
+type SceneOccluders struct {
+	cellSize  float32
+	refresh   func(segs ...Segment)
+	occluders *Occluders
+}
+
+// NewSceneOccluders cellSize见NewOccluders
+func NewSceneOccluders(cellSize float32, refresh func(segs ...Segment)) SceneOccluders {
+	return SceneOccluders{cellSize: cellSize, refresh: refresh}
+}
+
+// Add id已经存在时替换，新旧线段附近都需要重新计算
+func (s *SceneOccluders) Add(id int, seg Segment) {
+	if s.occluders == nil {
+		s.occluders = NewOccluders(s.cellSize)
+	}
+	if old, replaced := s.occluders.Add(id, seg); replaced {
+		s.refresh(old, seg)
+		return
+	}
+	s.refresh(seg)
+}
+
+func (s *SceneOccluders) Remove(id int) error {
+	if s.occluders == nil {
+		return ErrOccluderNotFound
+	}
+	seg, ok := s.occluders.Remove(id)
+	if !ok {
+		return ErrOccluderNotFound
+	}
+	s.refresh(seg)
+	return nil
+}
+
+// SetEnabled 状态没有变化时不需要重新计算
+func (s *SceneOccluders) SetEnabled(id int, enabled bool) error {
+	if s.occluders == nil {
+		return ErrOccluderNotFound
+	}
+	seg, changed, err := s.occluders.SetEnabled(id, enabled)
+	if err != nil {
+		return err
+	}
+	if changed {
+		s.refresh(seg)
+	}
+	return nil
+}
+
+// Empty 没有任何遮挡物
+func (s *SceneOccluders) Empty() bool {
+	return s.occluders == nil || s.occluders.Len() == 0
+}
+
+// Blocked 视线被挡住，没有遮挡物时总是false
+func (s *SceneOccluders) Blocked(a, b Position) bool {
+	return s.occluders != nil && s.occluders.Blocked(a, b)
+}
+
+// Near p离线段的包围盒在X、Y方向上都不超过reach，场景用它找出遮挡物变化时需要重新计算的Entity
+func (seg Segment) Near(p Position, reach float32) bool {
+	minX, maxX := math.Min(float64(seg.A.X), float64(seg.B.X)), math.Max(float64(seg.A.X), float64(seg.B.X))
+	minY, maxY := math.Min(float64(seg.A.Y), float64(seg.B.Y)), math.Max(float64(seg.A.Y), float64(seg.B.Y))
+	r := float64(reach)
+	return float64(p.X) >= minX-r && float64(p.X) <= maxX+r && float64(p.Y) >= minY-r && float64(p.Y) <= maxY+r
+}
+
+// 视线ab是否被遮挡物cd挡住，统一用float64计算
+func crosses(a, b, c, d Position) bool {
+	d1, d2 := orientation(c, d, a), orientation(c, d, b)
+	d3, d4 := orientation(a, b, c), orientation(a, b, d)
+	if d1 == 0 && d2 == 0 {
+		// 共线
+		return false
+	}
+	if (d1 > 0 && d2 < 0 || d1 < 0 && d2 > 0) && (d3 > 0 && d4 < 0 || d3 < 0 && d4 > 0) {
+		return true
+	}
+	// 遮挡物的端点落在视线的中间
+	if d3 == 0 && d1*d2 < 0 && c != a && c != b && between(a, b, c) {
+		return true
+	}
+	return d4 == 0 && d1*d2 < 0 && d != a && d != b && between(a, b, d)
+}
+
+// 点c相对于有向线段ab的方向，>0在左边，<0在右边，=0共线
+func orientation(a, b, c Position) float64 {
+	return (float64(b.X)-float64(a.X))*(float64(c.Y)-float64(a.Y)) - (float64(b.Y)-float64(a.Y))*(float64(c.X)-float64(a.X))
+}
+
+// 和ab共线的点c是否在ab的包围盒内
+func between(a, b, c Position) bool {
+	return math.Min(float64(a.X), float64(b.X)) <= float64(c.X) && float64(c.X) <= math.Max(float64(a.X), float64(b.X)) &&
+		math.Min(float64(a.Y), float64(b.Y)) <= float64(c.Y) && float64(c.Y) <= math.Max(float64(a.Y), float64(b.Y))
+}
+
+// SegmentsFromTiles 把width * height的瓦片阻挡掩码转换成遮挡线段，瓦片(x, y)覆盖
+// [origin.X + x*tileSize, origin.X + (x+1)*tileSize) * [origin.Y + y*tileSize, origin.Y + (y+1)*tileSize)，
+// 只生成阻挡瓦片和可通行瓦片(或者地图外)之间的边，同一行(列)上相邻的边合并成一条
+func SegmentsFromTiles(width, height int, blocked func(x, y int) bool, tileSize float32, origin Position) (result []Segment) {
+	isBlocked := func(x, y int) bool {
+		return x >= 0 && x < width && y >= 0 && y < height && blocked(x, y)
+	}
+	point := func(x, y int) Position {
+		return Position{X: origin.X + float32(x)*tileSize, Y: origin.Y + float32(y)*tileSize}
+	}
+	// 水平的边: 第y条线上，瓦片(x, y-1)和(x, y)一个阻挡一个不阻挡
+	for y := 0; y <= height; y++ {
+		start := -1
+		for x := 0; x <= width; x++ {
+			edge := x < width && isBlocked(x, y-1) != isBlocked(x, y)
+			if edge && start < 0 {
+				start = x
+			} else if !edge && start >= 0 {
+				result = append(result, Segment{point(start, y), point(x, y)})
+				start = -1
+			}
+		}
+	}
+	// 竖直的边: 第x条线上，瓦片(x-1, y)和(x, y)一个阻挡一个不阻挡
+	for x := 0; x <= width; x++ {
+		start := -1
+		for y := 0; y <= height; y++ {
+			edge := y < height && isBlocked(x-1, y) != isBlocked(x, y)
+			if edge && start < 0 {
+				start = y
+			} else if !edge && start >= 0 {
+				result = append(result, Segment{point(x, start), point(x, y)})
+				start = -1
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,139 @@
+package aoi
+
+import "testing"
+
+func TestOccludersBlocked(t *testing.T) {
+	p := func(x, y float32) Position { return Position{X: x, Y: y} }
+	o := NewOccluders(4)
+	o.Add(1, Segment{p(5, 0), p(5, 10)})
+	o.Add(2, Segment{p(5, 10), p(5, 20)}) // 和1首尾相接
+	o.Add(3, Segment{p(100, 0), p(100, 10)})
+
+	cases := []struct {
+		name    string
+		a, b    Position
+		blocked bool
+	}{
+		{"cross", p(0, 5), p(10, 5), true},
+		{"same side", p(0, 5), p(4, 15), false},
+		{"past the end", p(0, 25), p(10, 25), false},
+		{"through the seam", p(0, 10), p(10, 10), true},
+		{"through the seam diagonally", p(0, 5), p(10, 15), true},
+		{"stand on the wall", p(5, 5), p(10, 5), false},
+		{"along the wall", p(5, -5), p(5, 25), false},
+		{"long line over many cells", p(-50, 3), p(150, 7), true},
+		{"z is ignored", Position{X: 0, Y: 5, Z: -100}, Position{X: 10, Y: 5, Z: 100}, true},
+	}
+	for _, c := range cases {
+		if got := o.Blocked(c.a, c.b); got != c.blocked {
+			t.Errorf("%s: blocked %v, expect %v", c.name, got, c.blocked)
+		}
+		if got := o.Blocked(c.b, c.a); got != c.blocked {
+			t.Errorf("%s reversed: blocked %v, expect %v", c.name, got, c.blocked)
+		}
+	}
+
+	// 两段墙都打开之后不再遮挡
+	if _, changed, err := o.SetEnabled(1, false); !changed || err != nil {
+		t.Fatalf("disable 1: %v %v", changed, err)
+	}
+	if _, changed, _ := o.SetEnabled(1, false); changed {
+		t.Fatalf("disable twice should not change")
+	}
+	if !o.Blocked(p(0, 10), p(10, 10)) {
+		t.Fatalf("seam is still blocked by 2")
+	}
+	o.SetEnabled(2, false)
+	if o.Blocked(p(0, 10), p(10, 10)) || o.Blocked(p(0, 5), p(10, 5)) {
+		t.Fatalf("open doors should not block")
+	}
+	if _, _, err := o.SetEnabled(4, true); err != ErrOccluderNotFound {
+		t.Fatalf("toggle missing occluder: %v", err)
+	}
+
+	// 替换和删除之后桶里不再留有旧的线段
+	if old, replaced := o.Add(3, Segment{p(0, 50), p(10, 50)}); !replaced || old.A != p(100, 0) {
+		t.Fatalf("replace 3: %v %v", old, replaced)
+	}
+	if o.Blocked(p(95, 5), p(105, 5)) || !o.Blocked(p(5, 45), p(5, 55)) {
+		t.Fatalf("replaced occluder should move")
+	}
+	o.Remove(1)
+	o.Remove(2)
+	o.Remove(3)
+	if o.Len() != 0 || len(o.cells) != 0 {
+		t.Fatalf("cells should be empty: %d %v", o.Len(), o.cells)
+	}
+}
+
+func TestSegmentsFromTiles(t *testing.T) {
+	// # 是阻挡的瓦片，第0行在下面
+	mask := []string{
+		"##..",
+		"#...",
+		"....",
+	}
+	blocked := func(x, y int) bool { return mask[y][x] == '#' }
+	segs := SegmentsFromTiles(4, 3, blocked, 2, Position{X: 10, Y: 10})
+	expect := []Segment{
+		{Position{X: 10, Y: 10}, Position{X: 14, Y: 10}}, // (0,0)、(1,0)的下边
+		{Position{X: 12, Y: 12}, Position{X: 14, Y: 12}}, // (1,0)的上边
+		{Position{X: 10, Y: 14}, Position{X: 12, Y: 14}}, // (0,1)的上边
+		{Position{X: 10, Y: 10}, Position{X: 10, Y: 14}}, // (0,0)、(0,1)的左边
+		{Position{X: 12, Y: 12}, Position{X: 12, Y: 14}}, // (0,1)的右边
+		{Position{X: 14, Y: 10}, Position{X: 14, Y: 12}}, // (1,0)的右边
+	}
+	if len(segs) != len(expect) {
+		t.Fatalf("got %v, expect %v", segs, expect)
+	}
+	for i := range segs {
+		if segs[i] != expect[i] {
+			t.Fatalf("segment %d is %v, expect %v", i, segs[i], expect[i])
+		}
+	}
+
+	o := NewOccluders(0)
+	for i, seg := range segs {
+		o.Add(i, seg)
+	}
+	// 墙角外侧能看到，穿过阻挡的瓦片看不到
+	if o.Blocked(Position{X: 15, Y: 13}, Position{X: 13, Y: 15}) {
+		t.Fatalf("line outside the corner should not be blocked")
+	}
+	if !o.Blocked(Position{X: 15, Y: 11}, Position{X: 11, Y: 15}) {
+		t.Fatalf("line through the corner should be blocked")
+	}
+}
+
+func TestSceneOccludersRefresh(t *testing.T) {
+	var refreshed [][]Segment
+	o := NewSceneOccluders(4, func(segs ...Segment) {
+		refreshed = append(refreshed, segs)
+	})
+	a := Segment{Position{X: 5}, Position{X: 5, Y: 10}}
+	b := Segment{Position{X: 50}, Position{X: 50, Y: 10}}
+	if err := o.Remove(1); err != ErrOccluderNotFound || !o.Empty() || o.Blocked(Position{Y: 5}, Position{X: 10, Y: 5}) {
+		t.Fatalf("empty occluders: %v", err)
+	}
+	if err := o.SetEnabled(1, false); err != ErrOccluderNotFound {
+		t.Fatalf("toggle before add: %v", err)
+	}
+
+	o.Add(1, a)
+	o.Add(1, b) // 替换时新旧线段附近都要重新计算
+	o.SetEnabled(1, true)
+	o.SetEnabled(1, false)
+	o.Remove(1)
+	expect := [][]Segment{{a}, {a, b}, {b}, {b}}
+	if len(refreshed) != len(expect) {
+		t.Fatalf("refreshed %v, expect %v", refreshed, expect)
+	}
+	for i := range expect {
+		if len(refreshed[i]) != len(expect[i]) || refreshed[i][0] != expect[i][0] || refreshed[i][len(expect[i])-1] != expect[i][len(expect[i])-1] {
+			t.Fatalf("refresh %d is %v, expect %v", i, refreshed[i], expect[i])
+		}
+	}
+	if !o.Empty() {
+		t.Fatalf("occluders should be empty after remove")
+	}
+}
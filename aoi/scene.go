@@ -0,0 +1,49 @@
+package aoi
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+/*
+	[思路]
+	九宫格(grid)、十字链表(crosschain)、四叉树(quadtree)、全场景广播(infinitySight)四种实现都以Scene的形式提供，
+	上层只面向该接口编程，每个场景可以按地图类型自由选择合适的实现，aoisim可以用同样的负载对比各个实现
+*/
+
+var (
+	ErrEntityExists   = errors.New("aoi: entity already in scene")
+	ErrEntityNotFound = errors.New("aoi: entity not in scene")
+	ErrOutOfBounds    = errors.New("aoi: position out of scene bounds")
+	ErrNotSupported   = errors.New("aoi: operation not supported by scene")
+)
+
+type Scene interface {
+	// Enter 以id进入场景，之后该Entity相关的AOI事件都会投递给listener
+	Enter(id int64, pos Position, listener Listener) error
+	// Leave 离开场景，能看到该Entity的其他Entity会收到EventLeave
+	Leave(id int64) error
+	// Move 移动到新的位置
+	Move(id int64, pos Position) error
+	// Visible 获取id当前能看到的Entity列表
+	Visible(id int64) []int64
+}
+
+// RangeQuerier 范围查询，只返回Entity id，不触发任何AOI事件
+type RangeQuerier interface {
+	// QueryRadius 以center为圆心、radius为半径的圆内(含边界)的Entity
+	QueryRadius(center Position, radius float32) []int64
+	// QueryRect 以min和max为对角的矩形内(含边界)的Entity
+	QueryRect(min, max Position) []int64
+}
+
+// ReserveId 保证自增的id生成器gen之后生成的id都大于id，以指定id进入场景或者恢复快照之后调用，
+// 避免NewEntity生成的id和已经在场景里的重复
+func ReserveId(gen *int64, id int64) {
+	for {
+		current := atomic.LoadInt64(gen)
+		if current >= id || atomic.CompareAndSwapInt64(gen, current, id) {
+			return
+		}
+	}
+}
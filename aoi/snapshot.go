@@ -0,0 +1,32 @@
+package aoi
+
+/*
+	[思路]
+	迁服、宕机恢复时需要把场景存下来，再原样重建。快照只保存Entity自身的状态(id、位置、视野、可见性掩码)，
+	可见关系在恢复时按同样的规则重新计算，场景的Config、Filter、Listener由使用方在恢复时重新提供
+	快照可以直接用encoding/json序列化，字段名尽量短，Entity按id排序保证同一个场景导出的结果稳定
+	恢复时默认不发送任何事件，否则观察者会在一瞬间收到大量enter；需要通知客户端重新同步时再打开notify
+	开启了防抖的场景，恢复后只保留视野范围内的可见关系，处在防抖范围内的会按离开处理(不发送事件)
+*/
+
+type EntitySnapshot struct {
+	Id         int64      `json:"id"`
+	Position   Position   `json:"pos"`
+	SightX     float32    `json:"sx,omitempty"` // 每个Entity有独立视野的实现才会保存，为0时使用场景的默认视野
+	SightY     float32    `json:"sy,omitempty"`
+	SightZ     float32    `json:"sz,omitempty"`
+	Visibility Visibility `json:"vis"`
+}
+
+type Snapshot struct {
+	Entities []EntitySnapshot `json:"entities"`
+}
+
+// Snapshotter 支持存档和恢复的场景实现该接口
+type Snapshotter interface {
+	// Snapshot 导出场景内所有Entity的状态
+	Snapshot() Snapshot
+	// Restore 把快照里的Entity加入场景，listener按id提供恢复后的Listener，可以为nil
+	// notify为false时不发送任何事件；快照里有场景内已经存在的id或者越界的位置时返回错误，场景保持不变
+	Restore(snap Snapshot, listener func(id int64) Listener, notify bool) error
+}
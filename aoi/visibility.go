@@ -0,0 +1,38 @@
+package aoi
+
+/*
+	[思路]
+	几何上的视野范围之外，还有两层可见性判断:
+	1. Visibility掩码: 每个Entity有自己所在的层(Layer)和能看到的层(Mask)，
+	   watcher.Mask & target.Layer != 0 时才能看到对方。隐身的GM可以把Layer设为0，潜行的玩家放到LayerStealth，
+	   能反隐的Entity把LayerStealth加进Mask即可
+	2. Filter回调: 处理队伍可见的NPC、任务相位等依赖游戏逻辑的情况，Filter依赖的状态变化后需要调用场景的Refresh
+*/
+
+const (
+	LayerDefault uint64 = 1 << iota // 普通Entity所在的层
+	LayerStealth                    // 潜行
+)
+
+type Visibility struct {
+	Layer uint64 // 自己所在的层，为0时谁都看不到自己
+	Mask  uint64 // 自己能看到的层
+}
+
+// DefaultVisibility 在默认层，也只能看到默认层
+var DefaultVisibility = Visibility{Layer: LayerDefault, Mask: LayerDefault}
+
+func (v Visibility) CanSee(target Visibility) bool {
+	return v.Mask&target.Layer != 0
+}
+
+// Filter 返回watcher能否看到target，在场景锁内调用，不能再调用场景的方法
+type Filter func(watcher, target int64) bool
+
+// VisibilityScene 支持可见性掩码和Filter的场景实现该接口
+type VisibilityScene interface {
+	// SetVisibility 修改id的可见性掩码，并按新的掩码重新计算可见关系
+	SetVisibility(id int64, v Visibility) error
+	// Refresh Filter依赖的外部状态(队伍、相位等)变化后，重新计算id和周围Entity的可见关系
+	Refresh(id int64) error
+}
@@ -0,0 +1,291 @@
+package aoi
+
+import (
+	"errors"
+	"sync"
+)
+
+/*
+	[思路]
+	大地图被切成相邻的多个区域(Zone)，每个区域一个Scene。Entity只属于一个区域(owner)，
+	走到离其他区域的边界不足border时，在那个区域里放一个同id的影子(ghost)，邻居区域里边界附近的观察者通过影子看到它，
+	影子在邻居区域的场景里是一个完整的Entity，同样会观察周围，只是发给影子的事件不转发给Entity自己；
+	影子只跟随本体移动，Transfer时影子的可见集合就是Entity在新区域里的视野
+	Transfer把Entity的本体切换到另一个区域: 目标区域里已经有影子时只是把影子和本体的身份互换，
+	两边的观察者看到的都是同一个节点，不会收到leave/enter；Entity自己的视野从旧区域换成新区域，只收到两边可见集合的差集
+	所有区域的场景都只能通过World访问，内部场景投递的事件都发生在World持锁的调用里，释放锁之后再统一投递
+	区域按[Min, Max)的矩形划分，只看X、Y坐标；有边界的内部场景需要把边界向外扩大border，否则影子放不进去
+*/
+
+var (
+	ErrZoneExists   = errors.New("aoi: zone already exists")
+	ErrZoneNotFound = errors.New("aoi: zone not found")
+)
+
+type zone struct {
+	id    int
+	min   Position
+	max   Position
+	scene Scene
+}
+
+// pos在区域内
+func (z *zone) contains(pos Position) bool {
+	return pos.X >= z.min.X && pos.X < z.max.X && pos.Y >= z.min.Y && pos.Y < z.max.Y
+}
+
+// pos在区域向外扩大border之后的范围内
+func (z *zone) near(pos Position, border float32) bool {
+	return pos.X >= z.min.X-border && pos.X < z.max.X+border && pos.Y >= z.min.Y-border && pos.Y < z.max.Y+border
+}
+
+type worldEntity struct {
+	id       int64
+	pos      Position
+	listener Listener
+	owner    *zone
+	copies   map[int]*zone // 本体和影子所在的区域
+}
+
+type World struct {
+	sync.Mutex
+	border     float32
+	zones      []*zone
+	entities   map[int64]*worldEntity
+	dispatcher Dispatcher // 本次调用产生的事件，释放锁之后再投递
+}
+
+var (
+	_ Scene   = (*World)(nil)
+	_ Flusher = (*World)(nil)
+)
+
+// NewWorld border是边界区域的宽度，通常不小于视野距离，边界两侧的观察者才能无缝地看到对方
+func NewWorld(border float32) *World {
+	return &World{border: border, entities: make(map[int64]*worldEntity)}
+}
+
+// AddZone 添加一个区域，区域之间不能重叠，需要在Entity进入之前添加
+func (w *World) AddZone(id int, min, max Position, scene Scene) error {
+	w.Lock()
+	defer w.Unlock()
+	if w.findZone(id) != nil {
+		return ErrZoneExists
+	}
+	w.zones = append(w.zones, &zone{id: id, min: min, max: max, scene: scene})
+	return nil
+}
+
+// Enter 进入pos所在的区域，不在任何区域内时返回ErrOutOfBounds
+func (w *World) Enter(id int64, pos Position, listener Listener) error {
+	w.Lock()
+	defer w.dispatcher.UnlockAndDispatch(w)
+	if _, ok := w.entities[id]; ok {
+		return ErrEntityExists
+	}
+	var owner *zone
+	for _, z := range w.zones {
+		if z.contains(pos) {
+			owner = z
+			break
+		}
+	}
+	if owner == nil {
+		return ErrOutOfBounds
+	}
+	e := &worldEntity{id: id, pos: pos, listener: listener, owner: owner, copies: make(map[int]*zone)}
+	w.entities[id] = e
+	if err := owner.scene.Enter(id, pos, w.proxy(owner)); err != nil {
+		delete(w.entities, id)
+		return err
+	}
+	e.copies[owner.id] = owner
+	w.syncGhosts(e)
+	return nil
+}
+
+// Leave 本体和所有影子一起离开
+func (w *World) Leave(id int64) error {
+	w.Lock()
+	defer w.dispatcher.UnlockAndDispatch(w)
+	e, ok := w.entities[id]
+	if !ok {
+		return ErrEntityNotFound
+	}
+	e.owner.scene.Leave(id)
+	for zoneId, z := range e.copies {
+		if z != e.owner {
+			z.scene.Leave(id)
+		}
+		delete(e.copies, zoneId)
+	}
+	delete(w.entities, id)
+	return nil
+}
+
+// Move 在本体所在的区域内移动，并让影子跟随，走出区域之后需要调用Transfer切换区域
+func (w *World) Move(id int64, pos Position) error {
+	w.Lock()
+	defer w.dispatcher.UnlockAndDispatch(w)
+	e, ok := w.entities[id]
+	if !ok {
+		return ErrEntityNotFound
+	}
+	if err := e.owner.scene.Move(id, pos); err != nil {
+		return err
+	}
+	e.pos = pos
+	w.syncGhosts(e)
+	return nil
+}
+
+// Visible 本体所在区域里能看到的Entity，包括邻居区域放过来的影子
+func (w *World) Visible(id int64) []int64 {
+	w.Lock()
+	defer w.Unlock()
+	e, ok := w.entities[id]
+	if !ok {
+		return nil
+	}
+	return e.owner.scene.Visible(id)
+}
+
+// Owner 获取Entity本体所在的区域
+func (w *World) Owner(id int64) (zoneId int, ok bool) {
+	w.Lock()
+	defer w.Unlock()
+	e, ok := w.entities[id]
+	if !ok {
+		return 0, false
+	}
+	return e.owner.id, true
+}
+
+// Transfer 原子地把Entity的本体切换到zoneId区域，旧区域的本体在边界范围内时变成影子，否则离开旧区域
+// Entity当前的位置不在zoneId区域内时返回ErrOutOfBounds
+// 新旧两个区域的场景开启了批量模式时，会先把它们缓存的事件投递掉
+func (w *World) Transfer(id int64, zoneId int) error {
+	w.Lock()
+	defer w.dispatcher.UnlockAndDispatch(w)
+	e, ok := w.entities[id]
+	if !ok {
+		return ErrEntityNotFound
+	}
+	target := w.findZone(zoneId)
+	if target == nil {
+		return ErrZoneNotFound
+	}
+	if !target.contains(e.pos) {
+		return ErrOutOfBounds
+	}
+	old := e.owner
+	if target == old {
+		return nil
+	}
+	if _, ok := e.copies[target.id]; !ok {
+		if err := target.scene.Enter(id, e.pos, w.proxy(target)); err != nil {
+			return err
+		}
+		e.copies[target.id] = target
+	}
+	// 批量模式下两边的场景里可能还缓存着这一帧的事件，先在切换之前投递掉，
+	// 否则新区域里发给影子的enter会在切换之后的Flush里再发给Entity一次
+	for _, z := range []*zone{old, target} {
+		if f, ok := z.scene.(Flusher); ok {
+			f.Flush()
+		}
+	}
+
+	before, after := idSet(old.scene.Visible(id)), idSet(target.scene.Visible(id))
+	e.owner = target
+	if !old.near(e.pos, w.border) {
+		old.scene.Leave(id)
+		delete(e.copies, old.id)
+	}
+	// 自己的视野从旧区域换到新区域
+	for targetId := range before {
+		if _, ok := after[targetId]; !ok {
+			w.emit(e, EventLeave, targetId)
+		}
+	}
+	for targetId := range after {
+		if _, ok := before[targetId]; !ok {
+			w.emit(e, EventSync, targetId)
+		}
+	}
+	return nil
+}
+
+// Flush 依次Flush各个区域的场景
+func (w *World) Flush() {
+	w.Lock()
+	defer w.dispatcher.UnlockAndDispatch(w)
+	for _, z := range w.zones {
+		if f, ok := z.scene.(Flusher); ok {
+			f.Flush()
+		}
+	}
+}
+
+// 以下方法均需要持锁调用
+
+func (w *World) findZone(id int) *zone {
+	for _, z := range w.zones {
+		if z.id == id {
+			return z
+		}
+	}
+	return nil
+}
+
+// 按Entity当前的位置增删、移动各个邻居区域里的影子，邻居场景放不下影子时(比如越界)就不放
+func (w *World) syncGhosts(e *worldEntity) {
+	for _, z := range w.zones {
+		if z == e.owner {
+			continue
+		}
+		_, has := e.copies[z.id]
+		want := z.near(e.pos, w.border)
+		switch {
+		case want && has:
+			if z.scene.Move(e.id, e.pos) != nil {
+				z.scene.Leave(e.id)
+				delete(e.copies, z.id)
+			}
+		case want && !has:
+			if z.scene.Enter(e.id, e.pos, w.proxy(z)) == nil {
+				e.copies[z.id] = z
+			}
+		case !want && has:
+			z.scene.Leave(e.id)
+			delete(e.copies, z.id)
+		}
+	}
+}
+
+// 内部场景里的Listener，只有本体所在区域的事件才会转发，发给影子的事件直接丢弃
+func (w *World) proxy(z *zone) Listener {
+	return ListenerFunc(func(ev Event) {
+		e, ok := w.entities[ev.WatcherId]
+		if !ok || e.owner != z {
+			return
+		}
+		w.dispatcher.Add(e.listener, ev)
+	})
+}
+
+func (w *World) emit(e *worldEntity, category EventType, targetId int64) {
+	ev := Event{Type: category, WatcherId: e.id, TargetId: targetId}
+	if target, ok := w.entities[targetId]; ok {
+		ev.Position = target.pos
+	}
+	w.dispatcher.Add(e.listener, ev)
+}
+
+func idSet(ids []int64) map[int64]struct{} {
+	result := make(map[int64]struct{}, len(ids))
+	for _, id := range ids {
+		result[id] = struct{}{}
+	}
+	return result
+}